@@ -0,0 +1,356 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+)
+
+// A directory is sent as a bundle, which is a tar of everything in it,
+// with every entry under the name of the directory, as "tar c dir" would.
+
+// bundle reads a tar of a directory, which is written as it is read.
+type bundle struct {
+	*io.PipeReader
+	files uint32 // regular files in the bundle, once it has been read to the end
+}
+
+// newBundle starts writing a bundle of dir, called name. It is compressed
+// with zstd if compress is set.
+func newBundle(dir string, name string, compress bool) *bundle {
+	pr, pw := io.Pipe()
+	b := &bundle{PipeReader: pr}
+	go func() {
+		var w io.Writer = pw
+		var zw *zstd.Encoder
+		if compress {
+			zw, _ = zstd.NewWriter(pw)
+			w = zw
+		}
+		files, err := writeBundle(w, dir, name)
+		if err == nil && zw != nil {
+			err = zw.Close()
+		}
+		// set before the reader sees the end of the data
+		b.files = files
+		pw.CloseWithError(err)
+	}()
+	return b
+}
+
+// writeBundle writes a tar of dir to w, with every entry under name, and
+// returns the number of regular files in it.
+func writeBundle(w io.Writer, dir string, name string) (uint32, error) {
+	files := uint32(0)
+	tw := tar.NewWriter(w)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		link := ""
+		switch {
+		case info.IsDir(), info.Mode().IsRegular():
+		case info.Mode()&fs.ModeSymlink != 0:
+			link, err = os.Readlink(p)
+			if err != nil {
+				return err
+			}
+		default:
+			log.Warnf("skipping %s, only files, directories and symlinks can be sent", p)
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		hdr.Name = path.Join(name, filepath.ToSlash(rel))
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		// owners mean nothing on the machine it is pasted on
+		hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.CopyN(tw, f, hdr.Size)
+		if err != nil {
+			return fmt.Errorf("could not read %s: %v", p, err)
+		}
+		files++
+		return nil
+	})
+	if err != nil {
+		return files, err
+	}
+	return files, tw.Close()
+}
+
+// extraction is a bundle being extracted into a directory. Unless it is
+// being extracted over an existing directory, it is extracted to a
+// temporary directory beside it, which is moved into place once it is
+// complete.
+type extraction struct {
+	root      string // where the entries are being extracted to
+	target    string // where the bundle will be once it is complete
+	preserve  bool   // set the modes and times of what is extracted
+	staged    bool   // root is a temporary directory
+	committed bool
+}
+
+// newExtraction prepares to extract the bundle called name into dir, which
+// is created if need be. Unless force is set, it is an error for the
+// bundle's directory to exist already.
+func newExtraction(dir string, name string, force bool, preserve bool) (*extraction, error) {
+	name = cleanFilename(name)
+	if name == "" {
+		return nil, errors.New("bundle does not have a name")
+	}
+	x := &extraction{target: filepath.Join(dir, name), preserve: preserve}
+	if _, err := os.Lstat(x.target); err == nil {
+		if !force {
+			return nil, fmt.Errorf("%s already exists, use --force to extract over it", x.target)
+		}
+		x.root = x.target
+		return x, nil
+	}
+	err := os.MkdirAll(dir, 0o777)
+	if err != nil {
+		return nil, err
+	}
+	x.root, err = createTemp(dir, name, func(p string) error {
+		return os.Mkdir(p, 0o777)
+	})
+	if err != nil {
+		return nil, err
+	}
+	x.staged = true
+	return x, nil
+}
+
+// bundlePath checks the name of an entry in a bundle called name, and
+// returns where it goes, relative to the bundle's directory.
+func bundlePath(entry string, name string) (string, error) {
+	if path.IsAbs(entry) || strings.HasPrefix(entry, `\`) || filepath.VolumeName(entry) != "" {
+		return "", fmt.Errorf("bundle contains an absolute path %s", entry)
+	}
+	for _, elem := range strings.Split(strings.ReplaceAll(entry, `\`, "/"), "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("bundle contains a path outside of it %s", entry)
+		}
+	}
+	parts := strings.SplitN(path.Clean(entry), "/", 2)
+	if parts[0] != name {
+		return "", fmt.Errorf("bundle contains a path outside of it %s", entry)
+	}
+	if len(parts) == 1 {
+		return "", nil
+	}
+	return filepath.FromSlash(parts[1]), nil
+}
+
+// checkParents makes sure none of the directories leading to rel, under
+// root, are symlinks, so that nothing is written through one, and creates
+// any which are missing.
+func (x *extraction) checkParents(rel string) error {
+	dir := filepath.Dir(rel)
+	if dir == "." {
+		return nil
+	}
+	p := x.root
+	for _, elem := range strings.Split(dir, string(filepath.Separator)) {
+		p = filepath.Join(p, elem)
+		info, err := os.Lstat(p)
+		if errors.Is(err, os.ErrNotExist) {
+			err = os.Mkdir(p, 0o777)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", p)
+		}
+	}
+	return nil
+}
+
+// extract extracts the bundle read from r.
+func (x *extraction) extract(r io.Reader) error {
+	name := filepath.Base(x.target)
+	tr := tar.NewReader(r)
+	// directories are given their modes and times once everything in
+	// them is written, deepest first
+	dirs := []*tar.Header{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		rel, err := bundlePath(hdr.Name, name)
+		if err != nil {
+			return err
+		}
+		err = x.checkParents(rel)
+		if err != nil {
+			return err
+		}
+		p := filepath.Join(x.root, rel)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.Mkdir(p, 0o777)
+			if errors.Is(err, os.ErrExist) {
+				info, statErr := os.Lstat(p)
+				if statErr == nil && info.IsDir() {
+					err = nil
+				}
+			}
+			if err != nil {
+				return err
+			}
+			hdr.Name = p
+			dirs = append(dirs, hdr)
+		case tar.TypeReg:
+			err = x.extractFile(p, hdr, tr)
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			target := filepath.FromSlash(hdr.Linkname)
+			resolved := filepath.Join(filepath.Dir(rel), target)
+			if filepath.IsAbs(target) || resolved == ".." || strings.HasPrefix(resolved, ".."+string(filepath.Separator)) {
+				return fmt.Errorf("bundle contains a symlink %s to outside of it", hdr.Name)
+			}
+			err = removeExisting(p)
+			if err != nil {
+				return err
+			}
+			err = os.Symlink(target, p)
+			if err != nil {
+				return err
+			}
+		default:
+			log.Warnf("skipping %s in bundle, it is not a file, directory or symlink", hdr.Name)
+		}
+	}
+
+	if x.preserve {
+		for i := len(dirs) - 1; i >= 0; i-- {
+			err := os.Chmod(dirs[i].Name, dirs[i].FileInfo().Mode().Perm())
+			if err != nil {
+				return err
+			}
+			err = os.Chtimes(dirs[i].Name, dirs[i].ModTime, dirs[i].ModTime)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (x *extraction) extractFile(p string, hdr *tar.Header, r io.Reader) error {
+	err := removeExisting(p)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o666)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if x.preserve {
+		err = f.Chmod(hdr.FileInfo().Mode().Perm())
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	if x.preserve {
+		return os.Chtimes(p, hdr.ModTime, hdr.ModTime)
+	}
+	return nil
+}
+
+// removeExisting removes a file about to be extracted over, so that if it
+// is a symlink, it is not followed.
+func removeExisting(p string) error {
+	info, err := os.Lstat(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", p)
+	}
+	return os.Remove(p)
+}
+
+// Commit moves the extracted bundle into place.
+func (x *extraction) Commit() error {
+	if !x.staged {
+		x.committed = true
+		return nil
+	}
+	// unlike a file, a directory with anything in it can't be replaced by
+	// a rename, so this fails if something has appeared in its place
+	// meanwhile
+	err := os.Rename(x.root, x.target)
+	if err != nil {
+		_ = os.RemoveAll(x.root)
+		return err
+	}
+	x.committed = true
+	return nil
+}
+
+// Abort removes what has been extracted so far, unless it is being
+// extracted over an existing directory, when it has to be left.
+func (x *extraction) Abort() {
+	if x.committed || !x.staged {
+		return
+	}
+	_ = os.RemoveAll(x.root)
+}
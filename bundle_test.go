@@ -0,0 +1,89 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBundle(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	os.MkdirAll(filepath.Join(src, "sub"), 0o755)
+	os.WriteFile(filepath.Join(src, "a.txt"), []byte("a"), 0o644)
+	os.WriteFile(filepath.Join(src, "sub", "run.sh"), []byte("#!/bin/sh\n"), 0o755)
+	os.Symlink("../a.txt", filepath.Join(src, "sub", "link"))
+
+	buf := &bytes.Buffer{}
+	files, err := writeBundle(buf, src, "src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files != 2 {
+		t.Errorf("bundle has %d files, expected 2", files)
+	}
+
+	dest := t.TempDir()
+	x, err := newExtraction(dest, "src", false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = x.extract(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "src")); err == nil {
+		t.Error("bundle appeared before it was committed")
+	}
+	err = x.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data, _ := os.ReadFile(filepath.Join(dest, "src", "sub", "link")); string(data) != "a" {
+		t.Errorf("symlink reads %q", data)
+	}
+	info, err := os.Stat(filepath.Join(dest, "src", "sub", "run.sh"))
+	if err != nil || info.Mode().Perm() != 0o755 {
+		t.Errorf("script not extracted with its mode: %v %v", info, err)
+	}
+
+	if _, err := newExtraction(dest, "src", false, true); err == nil {
+		t.Error("no error extracting over an existing directory")
+	}
+}
+
+func TestBundleUnsafe(t *testing.T) {
+	for name, entries := range map[string][]tar.Header{
+		"absolute":        {{Name: "/etc/passwd", Typeflag: tar.TypeReg}},
+		"dot dot":         {{Name: "src/../../evil", Typeflag: tar.TypeReg}},
+		"outside":         {{Name: "other/file", Typeflag: tar.TypeReg}},
+		"absolute link":   {{Name: "src/link", Typeflag: tar.TypeSymlink, Linkname: "/etc"}},
+		"escaping link":   {{Name: "src/sub/link", Typeflag: tar.TypeSymlink, Linkname: "../../.."}},
+		"through symlink": {{Name: "src/link", Typeflag: tar.TypeSymlink, Linkname: "."}, {Name: "src/link/file", Typeflag: tar.TypeReg}},
+	} {
+		buf := &bytes.Buffer{}
+		tw := tar.NewWriter(buf)
+		for _, hdr := range entries {
+			hdr := hdr
+			hdr.Mode = 0o644
+			tw.WriteHeader(&hdr)
+		}
+		tw.Close()
+
+		dest := t.TempDir()
+		x, err := newExtraction(dest, "src", false, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := x.extract(buf); err == nil {
+			t.Errorf("%s: no error extracting", name)
+		}
+		x.Abort()
+		left, _ := os.ReadDir(dest)
+		if len(left) != 0 {
+			t.Errorf("%s: %d entries left behind", name, len(left))
+		}
+	}
+}
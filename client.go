@@ -3,12 +3,21 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/gob"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"text/template"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -20,73 +29,215 @@ import (
 type Client struct {
 	address    string
 	port       int
-	list       bool
-	send       bool
-	burnNum    int
-	receiveNum int
-	authToken  string
+	e2e        bool               // encrypt data sent with the team secret
+	teamSecret string             // for encrypting and decrypting data end to end
+	lock       bool               // lock the data sent with a passphrase
+	passphrase string             // for locking, or unlocking, an item, prompted for when needed
+	to         []secure.NamedKey  // encrypt the data sent to these recipients
+	identity   string             // path to our identity, for decrypting data sent to us
+	signingKey ed25519.PrivateKey // sign the data sent with this, if set
+	// signers we trust, and whether items not signed by one of them are an
+	// error rather than a warning
+	trustedSigners   []secure.NamedKey
+	requireSignature bool
+	list             bool
+	trash            bool
+	send             bool
+	inputs           []string // files to send, or none for stdin
+	name             string   // name to copy to
+	labels           []string // labels, metadata and note to copy with
+	meta             map[string]string
+	note             string
+	filter           []secure.Filter // which items to list
+	burnNum          int
+	burnName         string
+	burnVersion      uint32
+	burnSelector     *secure.Selector
+	burnIds          []uint32           // burn these, rather than by number
+	dryRun           bool               // show what would be burned instead
+	outputFormat     string             // write results as json, ndjson or tsv
+	format           *template.Template // write results with this template
+	purge            bool
+	restoreNum       int
+	restoreName      string
+	restoreVersion   uint32
+	restoreSelector  *secure.Selector
+	receiveNum       int
+	receiveName      string // paste the item with this name, rather than by number
+	receiveVersion   uint32 // and this version of it, rather than the current one
+	receiveSelector  *secure.Selector
+	member           string // paste just this member of an item
+	infoNum          int
+	infoName         string
+	infoVersion      uint32
+	infoSelector     *secure.Selector
+	historyName      string // list the versions of this name
+	rollbackName     string // roll this name back to a previous version
+	rollbackVersion  uint32
+	decompress       bool   // decompress compressed kinds when pasting
+	output           string // file or directory to paste to, or "" for stdout
+	force            bool   // overwrite the output file if it exists
+	preserve         bool   // set the mode and time of the output file to those of the file sent
+	authToken        string
+	compress         bool // offer to compress data on the way to and from the server
 }
 
 func (c *Client) Connect() error {
-	address := fmt.Sprintf("%s:%d", c.address, c.port)
+	if c.send && c.lock && c.passphrase == "" {
+		err := c.promptNewPassphrase()
+		if err != nil {
+			return err
+		}
+	}
 
-	d := net.Dialer{Timeout: 5 * time.Second}
+	var input *inputFile
+	if c.send {
+		var err error
+		input, err = c.openInput()
+		if err != nil {
+			return err
+		}
+		defer input.Close()
+		sent, err := c.sendByDigest(input)
+		if err != nil {
+			return err
+		}
+		if sent {
+			return nil
+		}
+	}
 
-	conn, err := d.Dial("tcp", address)
+	conn, enc, dec, err := c.dial()
 	if err != nil {
-		return fmt.Errorf("problem connecting to server, is it running?: %v", err)
+		return err
 	}
 	defer conn.Close()
 
-	log.Debugf("established connection on %s", address)
-
-	tcpConn, ok := conn.(*net.TCPConn)
-	if !ok {
-		log.Fatal("could not assert")
-	}
-
-	sharedKey := secure.Handshake(tcpConn)
-	secureConnection := secure.SecureConnection{Conn: conn, SharedKey: sharedKey, Buffer: &bytes.Buffer{}}
-
-	enc := gob.NewEncoder(&secureConnection)
-	dec := gob.NewDecoder(&secureConnection)
-
 	switch {
 	case c.list:
 		log.Debugf("requesting file list")
 
-		err := c.connectToServer(secure.OperationTypeList, enc, dec)
+		err := c.connectToServer(conn, secure.OperationTypeList, enc, dec)
 		if err != nil {
 			return fmt.Errorf("could not connect and auth: %v", err)
 		}
+		err = enc.Encode(secure.PacketListRequest{Filter: c.filter})
+		if err != nil {
+			panic(err)
+		}
 
-		// now we expect to get stuff back until we don't
-		numFiles := 0
-		for {
-			listPacket := secure.PacketListData{}
-			err := dec.Decode(&listPacket)
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				panic(err)
-			}
-			fmt.Printf("%d: %s (%s) - %s\n", listPacket.Id, listPacket.Kind, humanize.Bytes(uint64(listPacket.FileSize)), listPacket.Timestamp)
-			numFiles++
+		err = c.printList(dec)
+		if err != nil {
+			return err
 		}
-		fmt.Printf("total: %d files\n", numFiles)
 		conn.Close()
 		log.Debugf("done listing")
+	case c.trash:
+		log.Debugf("requesting trash list")
+
+		err := c.connectToServer(conn, secure.OperationTypeTrashList, enc, dec)
+		if err != nil {
+			return fmt.Errorf("could not connect and auth: %v", err)
+		}
+		err = enc.Encode(secure.PacketListRequest{Filter: c.filter})
+		if err != nil {
+			panic(err)
+		}
+
+		err = c.printList(dec)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+		log.Debugf("done listing trash")
+	case c.historyName != "":
+		log.Debugf("requesting history of %s", c.historyName)
+
+		err := c.connectToServer(conn, secure.OperationTypeHistory, enc, dec)
+		if err != nil {
+			return fmt.Errorf("could not connect and auth: %v", err)
+		}
+		err = enc.Encode(secure.PacketHistoryRequest{Name: c.historyName})
+		if err != nil {
+			panic(err)
+		}
+
+		err = c.printList(dec)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+		log.Debugf("done listing history")
+	case c.rollbackName != "":
+		log.Debugf("rolling back %s", c.rollbackName)
+
+		err := c.connectToServer(conn, secure.OperationTypeRollback, enc, dec)
+		if err != nil {
+			return fmt.Errorf("could not connect and auth: %v", err)
+		}
+		err = enc.Encode(secure.PacketRollbackRequest{Name: c.rollbackName, Version: c.rollbackVersion})
+		if err != nil {
+			panic(err)
+		}
+		res := secure.PacketRollbackResponse{}
+		err = dec.Decode(&res)
+		if err != nil {
+			panic(err)
+		}
+
+		switch res.Status {
+		case secure.RollbackResponseOK:
+			log.Debugf("%s is now version %d", res.Item.Name, res.Item.Version)
+		case secure.RollbackResponseNotFound:
+			log.Error("no such previous version")
+		default:
+			panic("unknown status")
+		}
+
+		conn.Close()
+	case c.infoNum >= 0:
+		log.Debugf("requesting info on %d", c.infoNum)
+
+		err := c.connectToServer(conn, secure.OperationTypeInfo, enc, dec)
+		if err != nil {
+			return fmt.Errorf("could not connect and auth: %v", err)
+		}
+		err = enc.Encode(secure.PacketInfoRequest{Id: uint32(c.infoNum), Name: c.infoName, Version: c.infoVersion, Selector: c.infoSelector})
+		if err != nil {
+			panic(err)
+		}
+		res := secure.PacketInfoResponse{}
+		err = dec.Decode(&res)
+		if err != nil {
+			return fmt.Errorf("did not get a response from the server: %v", err)
+		}
+
+		switch res.Status {
+		case secure.InfoResponseOK:
+			// the names of the members are only sent with their details
+			res.Item.Members = memberNames(res.Members)
+			c.printInfo(res)
+		case secure.InfoResponseNotFound:
+			log.Error("ngf not found")
+		default:
+			panic("unknown status")
+		}
+
+		conn.Close()
 	case c.receiveNum >= 0:
 		log.Debugf("receiving file %d", c.receiveNum)
 
-		err := c.connectToServer(secure.OperationTypeReceive, enc, dec)
+		err := c.connectToServer(conn, secure.OperationTypeReceive, enc, dec)
 		if err != nil {
 			return fmt.Errorf("could not connect and auth: %v", err)
 		}
 
 		req := secure.PacketReceiveDataStartRequest{
-			Id: uint32(c.receiveNum),
+			Id:       uint32(c.receiveNum),
+			Name:     c.receiveName,
+			Version:  c.receiveVersion,
+			Member:   c.member,
+			Selector: c.receiveSelector,
 		}
 		err = enc.Encode(req)
 		if err != nil {
@@ -96,25 +247,222 @@ func (c *Client) Connect() error {
 		res := secure.PacketReceiveDataStartResponse{}
 		err = dec.Decode(&res)
 		if err != nil {
-			panic(err)
+			return fmt.Errorf("did not get a response from the server: %v", err)
+		}
+
+		if res.Status == secure.ReceiveDataStartResponseOK && res.Encryption&secure.EncryptionPassphrase != 0 && c.passphrase == "" {
+			// the server won't wait while we prompt for the passphrase, so
+			// hang up, and ask again for the same item once we have it
+			conn.Close()
+			c.passphrase, err = readSecretFromTerminal("Enter passphrase: ")
+			if err != nil {
+				return fmt.Errorf("item is locked, could not get passphrase: %v", err)
+			}
+			c.receiveNum = int(res.Id)
+			c.receiveName = ""
+			c.receiveVersion = 0
+			c.receiveSelector = nil
+			return c.Connect()
 		}
 
 		switch res.Status {
 		case secure.ReceiveDataStartResponseOK:
-			for {
-				res := secure.PacketReceiveDataNext{}
-				err = dec.Decode(&res)
+			err = c.checkSignature(res)
+			if err != nil {
+				return err
+			}
+
+			var in io.Reader = &chunkReader{dec: dec}
+			if res.Encryption&secure.EncryptionTeam != 0 {
+				log.Debugf("decrypting with team secret")
+				in, err = secure.NewSecretReader(in, []byte(c.teamSecret))
+				if err != nil {
+					return fmt.Errorf("could not decrypt: %v", err)
+				}
+			}
+			if res.Encryption&secure.EncryptionPassphrase != 0 {
+				in, err = secure.NewSecretReader(in, []byte(c.passphrase))
+				if err != nil {
+					return fmt.Errorf("could not decrypt: %v", err)
+				}
+			}
+			if res.Encryption&secure.EncryptionRecipients != 0 {
+				log.Debugf("decrypting with identity %s", c.identity)
+				privateKey, err := loadIdentity(c.identity)
+				if err != nil {
+					return fmt.Errorf("item is encrypted to %s, could not load identity: %v", strings.Join(res.Recipients, ", "), err)
+				}
+				in, err = secure.NewRecipientReader(in, privateKey)
+				if errors.Is(err, secure.ErrNotRecipient) {
+					return fmt.Errorf("could not decrypt, item is encrypted to %s and not to you", strings.Join(res.Recipients, ", "))
+				}
+				if err != nil {
+					return fmt.Errorf("could not decrypt: %v", err)
+				}
+			}
+			// what is being pasted, which is the whole item, or one of its
+			// members
+			filename, mode, modTime, kind, digest := res.Filename, res.Mode, res.ModTime, res.Kind, res.Digest
+			member, memberOffset, isMember := findMember(res.Members, c.member)
+			if isMember {
+				filename, mode, modTime, kind = member.Name, member.Mode, member.ModTime, member.Kind
+				if res.MemberOnly {
+					digest = member.Digest
+				}
+			}
+
+			// a bundle pasted to a directory is extracted there, and so
+			// are the members of an item, as files
+			extract := res.Directory && c.output != ""
+			split := len(res.Members) > 0 && !isMember && c.output != ""
+			var w io.Writer = os.Stdout
+			var file *atomicFile
+			var bundle *extraction
+			var members *memberFiles
+			switch {
+			case extract:
+				bundle, err = newExtraction(c.output, filename, c.force, c.preserve)
+				if err != nil {
+					return err
+				}
+				defer bundle.Abort()
+				log.Debugf("extracting to %s", c.output)
+			case split:
+				members, err = newMemberFiles(c.output, res.Members, c.force, c.preserve)
+				if err != nil {
+					return err
+				}
+				defer members.Abort()
+				w = members
+				log.Debugf("writing files to %s", c.output)
+			case c.output != "":
+				path, err := outputPath(c.output, filename)
+				if err != nil {
+					return err
+				}
+				file, err = createAtomic(path, c.force)
+				if err != nil {
+					return err
+				}
+				defer file.Abort()
+				w = file
+				log.Debugf("writing to %s", path)
+			}
+
+			hash := sha256.New()
+			data := io.TeeReader(in, hash)
+			var out io.Reader = data
+			if isMember && !res.MemberOnly {
+				log.Debugf("picking out %s from the whole item", member.Name)
+				out = io.LimitReader(&skipReader{r: data, skip: int64(memberOffset)}, int64(member.Size))
+			}
+			decompressing := false
+			if c.decompress || extract {
+				dec, err := decompressReader(kind, out)
+				if err != nil {
+					return fmt.Errorf("could not decompress: %v", err)
+				}
+				if dec == nil && !extract {
+					if kind == "" {
+						kind = "of unknown kind"
+					}
+					log.Warnf("item is %s, not a kind that can be decompressed, pasting it as is", kind)
+				} else if dec != nil {
+					log.Debugf("decompressing %s", kind)
+					defer dec.Close()
+					out = dec
+					decompressing = true
+				}
+			}
+			if extract {
+				err = bundle.extract(out)
+			} else {
+				_, err = io.Copy(w, out)
+			}
+			if err == nil {
+				// read anything left, after the compressed data, the end
+				// of the bundle or the member, so the digest covers all
+				// of it
+				_, err = io.Copy(io.Discard, data)
+			}
+			if errors.Is(err, secure.ErrStreamDecrypt) {
+				if res.Encryption&secure.EncryptionPassphrase != 0 {
+					return errors.New("could not decrypt, wrong passphrase (or team secret)")
+				}
+				return errors.New("could not decrypt, is the team secret correct?")
+			}
+			if err != nil && extract {
+				return fmt.Errorf("could not extract: %v", err)
+			}
+			if err != nil && decompressing {
+				return fmt.Errorf("could not decompress: %v", err)
+			}
+			if err != nil {
+				panic(err)
+			}
+			if len(digest) > 0 && !bytes.Equal(digest, hash.Sum(nil)) {
+				if len(res.Signature) > 0 {
+					return errors.New("data received does not match the signature, it has been tampered with")
+				}
+				return errors.New("data received does not match the digest it was sent with")
+			}
+			if file != nil {
+				if c.preserve {
+					err = file.setMetadata(mode, modTime)
+					if err != nil {
+						return fmt.Errorf("could not set file mode and time: %v", err)
+					}
+				}
+				err = file.Commit()
+				if err != nil {
+					return fmt.Errorf("could not write output: %v", err)
+				}
+			}
+			if members != nil {
+				err = members.Commit()
+				if err != nil {
+					return fmt.Errorf("could not write output: %v", err)
+				}
+			}
+			if bundle != nil {
+				err = bundle.Commit()
 				if err != nil {
-					panic(err)
+					return fmt.Errorf("could not extract: %v", err)
+				}
+			}
+			if c.structured() {
+				result := pasteResult{Id: res.Id, Name: res.Name, Filename: filename, Kind: kind, Size: res.TotalSize, Decompressed: decompressing}
+				if isMember {
+					result.Member, result.Size = member.Name, member.Size
+				}
+				switch {
+				case file != nil:
+					result.Paths = []string{file.path}
+				case members != nil:
+					result.Paths = members.paths()
+				case bundle != nil:
+					result.Paths = []string{bundle.target}
+				}
+				// the data itself may be on stdout
+				w := os.Stderr
+				if c.output != "" {
+					w = os.Stdout
 				}
-				os.Stdout.Write(res.Data[:res.Size])
-				if res.Last {
-					break
+				records := c.newRecordWriter(w)
+				records.single = true
+				err = records.write(result)
+				if err == nil {
+					err = records.close()
+				}
+				if err != nil {
+					return err
 				}
 			}
 			log.Debugf("finished")
 		case secure.ReceiveDataStartResponseNotFound:
 			log.Error("ngf not found")
+		case secure.ReceiveDataStartResponseMemberNotFound:
+			return fmt.Errorf("item has no file called %s, it has: %s", c.member, strings.Join(memberNames(res.Members), ", "))
 		default:
 			panic("unknown status")
 		}
@@ -123,81 +471,240 @@ func (c *Client) Connect() error {
 	case c.send:
 		//  send mode
 
-		err := c.connectToServer(secure.OperationTypeSend, enc, dec)
+		err := c.connectToServer(conn, secure.OperationTypeSend, enc, dec)
 		if err != nil {
 			return fmt.Errorf("could not connect and auth: %v", err)
 		}
 
+		reader := bufio.NewReader(input)
+
 		data := secure.PacketSendDataStart{
-			Filename:  "",
+			Name:      c.name,
+			Filename:  input.name,
+			Mode:      input.mode,
+			ModTime:   input.modTime,
+			Labels:    c.labels,
+			Meta:      c.meta,
+			Note:      c.note,
+			Directory: input.bundle != nil,
 			TotalSize: 0,
 		}
+		if input.members != nil {
+			data.Members = input.members.members
+		}
+		if c.lock {
+			data.Encryption |= secure.EncryptionPassphrase
+		}
+		if c.e2e {
+			data.Encryption |= secure.EncryptionTeam
+		}
+		if len(c.to) > 0 {
+			data.Encryption |= secure.EncryptionRecipients
+			for _, r := range c.to {
+				data.Recipients = append(data.Recipients, r.Name)
+			}
+		}
+		head, _ := reader.Peek(kindSniffSize)
+		kind := detectKind(head)
+		if data.Encryption != 0 {
+			// the server cannot work out the kind of the data once it is
+			// encrypted, so we have to
+			data.Kind = kind
+		}
+		if data.Encryption != 0 || compressedKind(kind) {
+			log.Debugf("data will not compress, sending it as it is")
+			conn.SkipCompression(true)
+		}
 		err = enc.Encode(data)
 		if err != nil {
-			panic(err)
+			return fmt.Errorf("could not start sending: %v", err)
 		}
 
-		nBytes, nChunks := int64(0), int64(0)
-		reader := bufio.NewReader(os.Stdin)
-		buf := make([]byte, 0, 1024)
+		chunks := &chunkWriter{enc: enc}
+		var out io.Writer = chunks
+		// encryption layers, to be closed in reverse order once the data is written
+		layers := []io.Closer{}
 
-		for {
-			n, err := reader.Read(buf[:cap(buf)])
-
-			buf = buf[:n]
-
-			if n == 0 {
-				if err == nil {
-					continue
-				}
-				if err == io.EOF {
-					break
-				}
-				log.Fatal(err)
+		if c.e2e {
+			log.Debugf("encrypting with team secret")
+			sealer, err := secure.NewSecretWriter(out, []byte(c.teamSecret))
+			if err != nil {
+				return fmt.Errorf("could not encrypt: %v", err)
 			}
-			nChunks++
-			nBytes += int64(len(buf))
-
-			send := secure.PacketSendDataNext{
-				Size: 5000,
-				Data: buf,
+			out = sealer
+			layers = append(layers, sealer)
+		}
+		if c.lock {
+			log.Debugf("encrypting with passphrase")
+			sealer, err := secure.NewSecretWriter(out, []byte(c.passphrase))
+			if err != nil {
+				return fmt.Errorf("could not encrypt: %v", err)
+			}
+			out = sealer
+			layers = append(layers, sealer)
+		}
+		if len(c.to) > 0 {
+			log.Debugf("encrypting to %s", strings.Join(data.Recipients, ", "))
+			publicKeys := []*[32]byte{}
+			for _, r := range c.to {
+				publicKeys = append(publicKeys, r.PublicKey)
 			}
-			err = enc.Encode(send)
-			// time.Sleep(time.Second)
+			sealer, err := secure.NewRecipientWriter(out, publicKeys)
+			if err != nil {
+				return fmt.Errorf("could not encrypt: %v", err)
+			}
+			out = sealer
+			layers = append(layers, sealer)
+		}
+
+		hash := sha256.New()
+		nBytes, err := io.Copy(out, io.TeeReader(reader, hash))
+		if err != nil {
+			log.Fatal(err)
+		}
+		for i := len(layers) - 1; i >= 0; i-- {
+			err = layers[i].Close()
 			if err != nil {
 				log.Fatal(err)
 			}
 		}
-		log.Debugf("Sent %s in %d chunks", humanize.Bytes(uint64(nBytes)), nChunks)
+		log.Debugf("Sent %s in %d chunks", humanize.Bytes(uint64(nBytes)), chunks.chunks)
+
+		err = enc.Encode(secure.PacketSendDataNext{Last: true})
+		if err != nil {
+			panic(err)
+		}
+		end := secure.PacketSendDataEnd{Digest: hash.Sum(nil)}
+		if input.bundle != nil {
+			end.Files = input.bundle.files
+		}
+		if input.members != nil {
+			end.MemberDigests = input.members.digests()
+		}
+		if c.signingKey != nil {
+			log.Debugf("signing")
+			end.Signature = secure.SignDigest(c.signingKey, end.Digest)
+			end.Signer = c.signingKey.Public().(ed25519.PublicKey)
+		}
+		err = enc.Encode(end)
+		if err != nil {
+			return fmt.Errorf("could not finish sending, the data has not been stored: %v", err)
+		}
+		res := secure.PacketSendDataEndResponse{}
+		err = dec.Decode(&res)
+		if err != nil {
+			return fmt.Errorf("did not get a response from the server, the data may not have been stored: %v", err)
+		}
+		switch res.Status {
+		case secure.SendDataEndResponseOK:
+			log.Debugf("stored as %d", res.Id)
+		case secure.SendDataEndResponseBadSignature:
+			return errors.New("server rejected the signature")
+		case secure.SendDataEndResponseBadDigest:
+			return errors.New("data was corrupted on the way to the server")
+		default:
+			return errors.New("server could not store the data")
+		}
 
 		conn.Close()
 	case c.burnNum >= 0:
 		log.Debugf("burning file %d", c.burnNum)
 
-		err := c.connectToServer(secure.OperationTypeBurn, enc, dec)
+		err := c.connectToServer(conn, secure.OperationTypeBurn, enc, dec)
 		if err != nil {
 			return fmt.Errorf("could not connect and auth: %v", err)
 		}
 
 		req := secure.PacketBurnRequest{
-			Id: uint32(c.burnNum),
+			Id:       uint32(c.burnNum),
+			Name:     c.burnName,
+			Version:  c.burnVersion,
+			Purge:    c.purge,
+			Selector: c.burnSelector,
+			Ids:      c.burnIds,
+			DryRun:   c.dryRun,
 		}
 		err = enc.Encode(req)
 		if err != nil {
-			panic(err)
+			return fmt.Errorf("could not send burn request: %v", err)
 		}
-		// expect a response telling us if we can go ahead
+		// expect the outcome for each item, and then for the whole burn
 		res := secure.PacketBurnResponse{}
+		results := []secure.BurnResult{}
+		for !res.Done {
+			res = secure.PacketBurnResponse{}
+			err = dec.Decode(&res)
+			if err != nil {
+				return fmt.Errorf("did not get a response from the server, items may have been burned: %v", err)
+			}
+			if res.Result != nil {
+				results = append(results, *res.Result)
+			}
+		}
+
+		if c.structured() {
+			records := c.newRecordWriter(os.Stdout)
+			for _, result := range results {
+				err = records.write(c.burnResult(result, c.dryRun))
+				if err != nil {
+					return err
+				}
+			}
+			err = records.close()
+			if err != nil {
+				return err
+			}
+		} else if c.dryRun {
+			c.printBurnResults(results)
+		}
+
+		switch res.Status {
+		case secure.BurnResponseOK:
+			log.Debugf("finished")
+		case secure.BurnResponseNotFound:
+			if len(c.burnIds) == 0 {
+				log.Error("ngf not found")
+				break
+			}
+			for _, result := range results {
+				if result.Status != secure.BurnResponseOK {
+					log.Errorf("ngf %d not found", result.Id)
+				}
+			}
+		default:
+			panic("unknown status")
+		}
+
+		conn.Close()
+	case c.restoreNum >= 0:
+		log.Debugf("restoring file %d", c.restoreNum)
+
+		err := c.connectToServer(conn, secure.OperationTypeRestore, enc, dec)
+		if err != nil {
+			return fmt.Errorf("could not connect and auth: %v", err)
+		}
+
+		req := secure.PacketRestoreRequest{
+			Id:       uint32(c.restoreNum),
+			Name:     c.restoreName,
+			Version:  c.restoreVersion,
+			Selector: c.restoreSelector,
+		}
+		err = enc.Encode(req)
+		if err != nil {
+			panic(err)
+		}
+		res := secure.PacketRestoreResponse{}
 		err = dec.Decode(&res)
 		if err != nil {
 			panic(err)
 		}
 
 		switch res.Status {
-		case secure.BurnResponseOK:
+		case secure.RestoreResponseOK:
 			log.Debugf("finished")
-		case secure.BurnResponseNotFound:
-			log.Error("ngf not found")
+		case secure.RestoreResponseNotFound:
+			log.Error("ngf not found in trash")
 		default:
 			panic("unknown status")
 		}
@@ -209,7 +716,386 @@ func (c *Client) Connect() error {
 	return nil
 }
 
-func (c *Client) connectToServer(op secure.OperationTypeEnum, enc *gob.Encoder, dec *gob.Decoder) error {
+// dial connects to the server, returning the connection, and an encoder
+// and decoder to talk to the server securely over it.
+func (c *Client) dial() (*secure.SecureConnection, *gob.Encoder, *gob.Decoder, error) {
+	address := net.JoinHostPort(c.address, strconv.Itoa(c.port))
+
+	d := net.Dialer{Timeout: 5 * time.Second}
+
+	conn, err := d.Dial("tcp", address)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("problem connecting to server, is it running?: %v", err)
+	}
+
+	log.Debugf("established connection on %s", address)
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		log.Fatal("could not assert")
+	}
+
+	sharedKey := secure.Handshake(tcpConn)
+	secureConnection := &secure.SecureConnection{Conn: conn, SharedKey: sharedKey, Buffer: &bytes.Buffer{}}
+
+	return secureConnection, gob.NewEncoder(secureConnection), gob.NewDecoder(secureConnection), nil
+}
+
+// inputFile is the data to send, with the details of the file it came
+// from, if it was sent by name.
+type inputFile struct {
+	io.ReadCloser
+	file    *os.File      // the file, if the data is read straight from one
+	bundle  *bundle       // the bundle, if a directory is being sent
+	members *memberReader // the files, if more than one is being sent
+	name    string
+	mode    uint32
+	modTime time.Time
+}
+
+// openInput opens the data to send, which is the file or files given, or
+// stdin.
+func (c *Client) openInput() (*inputFile, error) {
+	if len(c.inputs) == 0 {
+		return &inputFile{ReadCloser: os.Stdin, file: os.Stdin}, nil
+	}
+	if len(c.inputs) > 1 {
+		members, err := openMembers(c.inputs)
+		if err != nil {
+			return nil, err
+		}
+		// the digests are not known until the members are read, but will
+		// take up as much room in the description of the item
+		described := NGF{Name: c.name, Labels: c.labels, Meta: c.meta, Note: c.note}
+		for _, m := range members.members {
+			m.Digest = make([]byte, sha256.Size)
+			described.Members = append(described.Members, m)
+		}
+		if err := described.describable(); err != nil {
+			members.Close()
+			return nil, err
+		}
+		return &inputFile{ReadCloser: members, members: members}, nil
+	}
+	input := c.inputs[0]
+	f, err := os.Open(input)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		f.Close()
+		abs, err := filepath.Abs(input)
+		if err != nil {
+			return nil, err
+		}
+		name := cleanFilename(filepath.Base(abs))
+		if name == "" {
+			return nil, fmt.Errorf("cannot send %s, it has no name", input)
+		}
+		// if the client is encrypting the data, the connection and server
+		// can't compress it, so it is compressed first
+		b := newBundle(input, name, c.e2e || c.lock || len(c.to) > 0)
+		return &inputFile{
+			ReadCloser: b,
+			bundle:     b,
+			name:       name,
+			mode:       uint32(info.Mode().Perm()),
+			modTime:    info.ModTime(),
+		}, nil
+	}
+	return &inputFile{
+		ReadCloser: f,
+		file:       f,
+		name:       filepath.Base(input),
+		mode:       uint32(info.Mode().Perm()),
+		modTime:    info.ModTime(),
+	}, nil
+}
+
+// digestMinSize is the smallest input it is worth checking the server for
+// before sending.
+const digestMinSize = 1024 * 1024
+
+// digestFrom returns the digest of the rest of f, which is at offset, and
+// the start of it to work out the kind from, and then goes back to offset
+// so that it can be sent after all.
+func digestFrom(f *os.File, offset int64) ([]byte, []byte, error) {
+	head := make([]byte, kindSniffSize)
+	n, _ := io.ReadFull(f, head)
+	hash := sha256.New()
+	hash.Write(head[:n])
+	_, err := io.Copy(hash, f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read input: %v", err)
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		// we can't go back to send it after all
+		return nil, nil, fmt.Errorf("could not rewind input: %v", err)
+	}
+	return hash.Sum(nil), head[:n], nil
+}
+
+// sendByDigest checks if the server already has the data we are about to
+// send, and if so asks it to store a new item using that, so the data does
+// not need to be sent again. This only applies to a regular file, which
+// is not being encrypted, as the data must be read twice. It returns
+// true if the item was stored.
+func (c *Client) sendByDigest(input *inputFile) (bool, error) {
+	if c.e2e || c.lock || len(c.to) > 0 || input.file == nil {
+		return false, nil
+	}
+	info, err := input.file.Stat()
+	if err != nil || !info.Mode().IsRegular() || info.Size() < digestMinSize {
+		return false, nil
+	}
+
+	// the data to send starts wherever the input is, which need not be
+	// the start of the file
+	start, err := input.file.Seek(0, io.SeekCurrent)
+	if err != nil || info.Size()-start < digestMinSize {
+		return false, nil
+	}
+	digest, head, err := digestFrom(input.file, start)
+	if err != nil {
+		return false, err
+	}
+
+	req := secure.PacketSendDigestRequest{
+		Name:     c.name,
+		Filename: input.name,
+		Mode:     input.mode,
+		ModTime:  input.modTime,
+		Labels:   c.labels,
+		Meta:     c.meta,
+		Note:     c.note,
+		Kind:     detectKind(head),
+		Digest:   digest,
+	}
+	if c.signingKey != nil {
+		req.Signature = secure.SignDigest(c.signingKey, req.Digest)
+		req.Signer = c.signingKey.Public().(ed25519.PublicKey)
+	}
+
+	conn, enc, dec, err := c.dial()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	err = c.connectToServer(conn, secure.OperationTypeSendDigest, enc, dec)
+	if err != nil {
+		return false, fmt.Errorf("could not connect and auth: %v", err)
+	}
+	err = enc.Encode(req)
+	if err != nil {
+		return false, err
+	}
+	res := secure.PacketSendDigestResponse{}
+	err = dec.Decode(&res)
+	if err != nil {
+		return false, err
+	}
+
+	switch res.Status {
+	case secure.SendDigestResponseOK:
+		log.Debugf("server already had the data, stored as %d", res.Id)
+		return true, nil
+	case secure.SendDigestResponseNotFound:
+		log.Debugf("server does not have the data, sending it")
+		return false, nil
+	case secure.SendDigestResponseBadSignature:
+		return false, errors.New("server rejected the signature")
+	default:
+		panic("unknown status")
+	}
+}
+
+// promptNewPassphrase asks for the passphrase to lock an item with,
+// twice to make sure it was typed correctly.
+func (c *Client) promptNewPassphrase() error {
+	passphrase, err := readSecretFromTerminal("Enter passphrase: ")
+	if err != nil {
+		return fmt.Errorf("could not get passphrase: %v", err)
+	}
+	if passphrase == "" {
+		return errors.New("passphrase cannot be empty")
+	}
+	confirm, err := readSecretFromTerminal("Confirm passphrase: ")
+	if err != nil {
+		return fmt.Errorf("could not get passphrase: %v", err)
+	}
+	if passphrase != confirm {
+		return errors.New("passphrases do not match")
+	}
+	c.passphrase = passphrase
+	return nil
+}
+
+// checkSignature checks the signature on an item about to be received,
+// returning an error if it is bad, or is not by a trusted signer and one
+// is required.
+func (c *Client) checkSignature(res secure.PacketReceiveDataStartResponse) error {
+	if len(res.Signature) == 0 {
+		if c.requireSignature {
+			return errors.New("item is not signed, and a signature is required")
+		}
+		return nil
+	}
+	if !secure.VerifyDigest(res.Signer, res.Digest, res.Signature) {
+		return errors.New("item has a bad signature")
+	}
+	name := signerName(c.trustedSigners, res.Signer)
+	if name == "" {
+		if c.requireSignature {
+			return fmt.Errorf("item is signed by an untrusted key %s", base64.StdEncoding.EncodeToString(res.Signer))
+		}
+		log.Warnf("item is signed by an untrusted key %s", base64.StdEncoding.EncodeToString(res.Signer))
+		return nil
+	}
+	log.Debugf("item is signed by %s", name)
+	return nil
+}
+
+// structured returns true if results are to be written for scripts, with
+// --output or --format.
+func (c *Client) structured() bool {
+	return c.outputFormat != "" || c.format != nil
+}
+
+// printList prints the list packets sent by the server until it closes
+// the connection.
+func (c *Client) printList(dec *gob.Decoder) error {
+	var records *recordWriter
+	if c.structured() {
+		records = c.newRecordWriter(os.Stdout)
+	}
+	numFiles := 0
+	for {
+		listPacket := secure.PacketListData{}
+		err := dec.Decode(&listPacket)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			panic(err)
+		}
+		numFiles++
+		if records != nil {
+			err = records.write(c.listItem(listPacket))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		c.printItem(listPacket)
+		fmt.Println()
+	}
+	if records != nil {
+		return records.close()
+	}
+	fmt.Printf("total: %d files\n", numFiles)
+	return nil
+}
+
+// printItem prints the summary of an item, as shown in the list, without
+// a newline.
+func (c *Client) printItem(item secure.PacketListData) {
+	size := humanize.Bytes(item.FileSize)
+	if item.StoredSize > 0 {
+		size += ", " + humanize.Bytes(item.StoredSize) + " stored"
+	}
+	if item.Name != "" {
+		fmt.Printf("%d (%s@%d): ", item.Id, item.Name, item.Version)
+	} else {
+		fmt.Printf("%d: ", item.Id)
+	}
+	if item.Filename != "" {
+		fmt.Printf("%s - ", item.Filename)
+	}
+	fmt.Printf("%s (%s) - %s", item.Kind, size, item.Timestamp)
+	if item.Directory {
+		fmt.Printf(" [directory: %d files]", item.Files)
+	}
+	if len(item.Members) > 0 {
+		names := item.Members
+		if len(names) > 3 {
+			names = append(names[:3:3], fmt.Sprintf("%d more", len(item.Members)-3))
+		}
+		fmt.Printf(" [files: %s]", strings.Join(names, ", "))
+	}
+	if len(item.Labels) > 0 {
+		fmt.Printf(" [labels: %s]", strings.Join(item.Labels, ", "))
+	}
+	if item.Encryption&secure.EncryptionTeam != 0 {
+		fmt.Print(" [e2e]")
+	}
+	if item.Encryption&secure.EncryptionPassphrase != 0 {
+		fmt.Print(" [locked]")
+	}
+	if item.Encryption&secure.EncryptionRecipients != 0 {
+		fmt.Printf(" [to: %s]", strings.Join(item.Recipients, ", "))
+	}
+	if len(item.Signer) > 0 {
+		name := signerName(c.trustedSigners, item.Signer)
+		if name == "" {
+			name = "untrusted " + base64.StdEncoding.EncodeToString(item.Signer)
+		}
+		fmt.Printf(" [signed: %s]", name)
+	}
+	if !item.BurnedAt.IsZero() {
+		fmt.Printf(" - burned %s", item.BurnedAt)
+	}
+	if item.Current {
+		fmt.Print(" [current]")
+	}
+}
+
+// printBurnResults prints the items a dry run of burning found.
+func (c *Client) printBurnResults(results []secure.BurnResult) {
+	numFiles := 0
+	for _, result := range results {
+		if result.Status != secure.BurnResponseOK {
+			continue
+		}
+		c.printItem(result.Item)
+		fmt.Println()
+		numFiles++
+	}
+	fmt.Printf("would burn: %d files\n", numFiles)
+}
+
+// printInfo prints the details of an item.
+func (c *Client) printInfo(info secure.PacketInfoResponse) {
+	c.printItem(info.Item)
+	fmt.Println()
+	if info.Item.Note != "" {
+		fmt.Printf("note: %s\n", info.Item.Note)
+	}
+	keys := make([]string, 0, len(info.Item.Meta))
+	for key := range info.Item.Meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("%s=%s\n", key, info.Item.Meta[key])
+	}
+	if len(info.Members) == 0 {
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "name\tsize\tkind\tmode\tmodified")
+	for _, m := range info.Members {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%v\t%s\n", m.Name, humanize.Bytes(m.Size), m.Kind, os.FileMode(m.Mode), m.ModTime.Format(time.RFC3339))
+	}
+	w.Flush()
+}
+
+func (c *Client) connectToServer(conn *secure.SecureConnection, op secure.OperationTypeEnum, enc *gob.Encoder, dec *gob.Decoder) error {
 	// list mode
 	startPacket := secure.PacketStartRequest{
 		OperationType:   op,
@@ -217,6 +1103,9 @@ func (c *Client) connectToServer(op secure.OperationTypeEnum, enc *gob.Encoder,
 		ProtocolVersion: ProtocolVersion,
 		AuthToken:       c.authToken,
 	}
+	if c.compress {
+		startPacket.Compression = secure.SupportedCompression
+	}
 	err := enc.Encode(startPacket)
 	if err != nil {
 		return fmt.Errorf("could not send start packet: %v", err)
@@ -238,5 +1127,64 @@ func (c *Client) connectToServer(op secure.OperationTypeEnum, enc *gob.Encoder,
 		log.Print("bad authtoken")
 		return errors.New("bad authtoken")
 	}
+	if response.Compression != "" {
+		log.Debugf("compressing with %s", response.Compression)
+	}
+	conn.SetCompression(response.Compression)
 	return nil
 }
+
+// sendChunkSize is the largest amount of data sent in a single
+// PacketSendDataNext.
+const sendChunkSize = 16 * 1024
+
+// chunkWriter sends everything written to it to the server as
+// PacketSendDataNext packets.
+type chunkWriter struct {
+	enc    *gob.Encoder
+	chunks int64
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > sendChunkSize {
+			n = sendChunkSize
+		}
+		err := w.enc.Encode(secure.PacketSendDataNext{Size: uint16(n), Data: p[:n]})
+		if err != nil {
+			return written, err
+		}
+		w.chunks++
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// chunkReader reads the data sent by the server in PacketReceiveDataNext
+// packets, until the last one.
+type chunkReader struct {
+	dec  *gob.Decoder
+	buf  []byte
+	last bool
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.last {
+			return 0, io.EOF
+		}
+		res := secure.PacketReceiveDataNext{}
+		err := r.dec.Decode(&res)
+		if err != nil {
+			return 0, err
+		}
+		r.buf = res.Data[:res.Size]
+		r.last = res.Last
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
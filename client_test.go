@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDigestFrom(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	p := filepath.Join(t.TempDir(), "data")
+	err := os.WriteFile(p, data, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// as if the input had been partly read already
+	_, err = f.Seek(15, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, head, err := digestFrom(f, 15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sha256.Sum256(data[15:])
+	if !bytes.Equal(digest, want[:]) {
+		t.Error("digest is not of the data from the offset")
+	}
+	if !bytes.HasPrefix(data[15:], head) || len(head) == 0 {
+		t.Errorf("head is %q", head)
+	}
+	rest, _ := io.ReadAll(f)
+	if !bytes.Equal(rest, data[15:]) {
+		t.Errorf("input was left at the wrong place, %d bytes left to send", len(rest))
+	}
+}
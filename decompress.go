@@ -0,0 +1,34 @@
+package main
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// decompressReader returns a reader which decompresses r, if the kind is
+// one we know how to decompress, or nil if it is not.
+func decompressReader(kind string, r io.Reader) (io.ReadCloser, error) {
+	switch kind {
+	case "application/gzip":
+		return gzip.NewReader(r)
+	case "application/x-bzip2":
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	case "application/x-xz":
+		x, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(x), nil
+	case "application/zstd":
+		z, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return z.IOReadCloser(), nil
+	}
+	return nil, nil
+}
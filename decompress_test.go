@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+func TestDecompressReader(t *testing.T) {
+	data := bytes.Repeat([]byte("netgiv "), 1000)
+
+	gz := &bytes.Buffer{}
+	gw := gzip.NewWriter(gz)
+	gw.Write(data)
+	gw.Close()
+
+	xzBuf := &bytes.Buffer{}
+	xw, _ := xz.NewWriter(xzBuf)
+	xw.Write(data)
+	xw.Close()
+
+	enc, _ := zstd.NewWriter(nil)
+	zst := enc.EncodeAll(data, nil)
+
+	for kind, compressed := range map[string][]byte{
+		"application/gzip": gz.Bytes(),
+		"application/x-xz": xzBuf.Bytes(),
+		"application/zstd": zst,
+	} {
+		if detectKind(compressed) != kind {
+			t.Errorf("%s detected as %s", kind, detectKind(compressed))
+		}
+		r, err := decompressReader(kind, bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatalf("%s: %v", kind, err)
+		}
+		out, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", kind, err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("%s: did not decompress to the original data", kind)
+		}
+	}
+
+	r, err := decompressReader("text/plain", bytes.NewReader(data))
+	if r != nil || err != nil {
+		t.Error("text should not be decompressed")
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/tardisx/netgiv/secure"
+)
+
+// With --output or --format, the results of listing, pasting and burning
+// are written for scripts to read, rather than people, as records with
+// sizes in bytes and times in RFC 3339.
+
+// outputFormats are the formats --output can write.
+var outputFormats = []string{"json", "ndjson", "tsv"}
+
+// A record is a result which can be written as a row of a TSV.
+type record interface {
+	tsvHeader() []string
+	tsvFields() []string
+}
+
+// listItem is an item, as listed.
+type listItem struct {
+	Id         uint32            `json:"id"`
+	Name       string            `json:"name,omitempty"`
+	Version    uint32            `json:"version,omitempty"`
+	Current    bool              `json:"current,omitempty"`
+	Filename   string            `json:"filename,omitempty"`
+	Kind       string            `json:"kind"`
+	Size       uint64            `json:"size"`
+	StoredSize uint64            `json:"stored_size"`
+	Timestamp  string            `json:"timestamp"`
+	BurnedAt   string            `json:"burned_at,omitempty"`
+	Encryption []string          `json:"encryption,omitempty"`
+	Recipients []string          `json:"recipients,omitempty"`
+	Signer     string            `json:"signer,omitempty"`
+	SignerName string            `json:"signer_name,omitempty"`
+	Directory  bool              `json:"directory,omitempty"`
+	Files      uint32            `json:"files,omitempty"`
+	Members    []string          `json:"members,omitempty"`
+	Labels     []string          `json:"labels,omitempty"`
+	Meta       map[string]string `json:"meta,omitempty"`
+	Note       string            `json:"note,omitempty"`
+}
+
+// listItem converts an item sent by the server for output.
+func (c *Client) listItem(item secure.PacketListData) listItem {
+	out := listItem{
+		Id:         item.Id,
+		Name:       item.Name,
+		Version:    item.Version,
+		Current:    item.Current,
+		Filename:   item.Filename,
+		Kind:       item.Kind,
+		Size:       item.FileSize,
+		StoredSize: item.StoredSize,
+		Timestamp:  formatTime(item.Timestamp),
+		BurnedAt:   formatTime(item.BurnedAt),
+		Recipients: item.Recipients,
+		Directory:  item.Directory,
+		Files:      item.Files,
+		Members:    item.Members,
+		Labels:     item.Labels,
+		Meta:       item.Meta,
+		Note:       item.Note,
+	}
+	if item.Encryption&secure.EncryptionTeam != 0 {
+		out.Encryption = append(out.Encryption, "e2e")
+	}
+	if item.Encryption&secure.EncryptionPassphrase != 0 {
+		out.Encryption = append(out.Encryption, "passphrase")
+	}
+	if item.Encryption&secure.EncryptionRecipients != 0 {
+		out.Encryption = append(out.Encryption, "recipients")
+	}
+	if len(item.Signer) > 0 {
+		out.Signer = base64.StdEncoding.EncodeToString(item.Signer)
+		out.SignerName = signerName(c.trustedSigners, item.Signer)
+	}
+	return out
+}
+
+func (i listItem) tsvHeader() []string {
+	return []string{"id", "name", "version", "filename", "kind", "size", "stored_size", "timestamp", "burned_at", "encryption", "signer_name", "labels", "meta", "note"}
+}
+
+func (i listItem) tsvFields() []string {
+	version := ""
+	if i.Version != 0 {
+		version = strconv.FormatUint(uint64(i.Version), 10)
+	}
+	keys := make([]string, 0, len(i.Meta))
+	for key := range i.Meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	meta := make([]string, 0, len(keys))
+	for _, key := range keys {
+		meta = append(meta, key+"="+i.Meta[key])
+	}
+	return []string{
+		strconv.FormatUint(uint64(i.Id), 10), i.Name, version, i.Filename, i.Kind,
+		strconv.FormatUint(i.Size, 10), strconv.FormatUint(i.StoredSize, 10), i.Timestamp, i.BurnedAt,
+		strings.Join(i.Encryption, ","), i.SignerName, strings.Join(i.Labels, ","), strings.Join(meta, ","), i.Note,
+	}
+}
+
+// burnResult is the outcome of burning an item.
+type burnResult struct {
+	Id     uint32    `json:"id"`
+	Status string    `json:"status"` // burned, would burn or not found
+	Item   *listItem `json:"item,omitempty"`
+}
+
+func (c *Client) burnResult(result secure.BurnResult, dryRun bool) burnResult {
+	out := burnResult{Id: result.Id, Status: "not found"}
+	if result.Status == secure.BurnResponseOK {
+		out.Status = "burned"
+		if dryRun {
+			out.Status = "would burn"
+		}
+		item := c.listItem(result.Item)
+		out.Item = &item
+	}
+	return out
+}
+
+func (r burnResult) tsvHeader() []string {
+	return []string{"id", "status", "filename", "kind", "size", "timestamp"}
+}
+
+func (r burnResult) tsvFields() []string {
+	fields := []string{strconv.FormatUint(uint64(r.Id), 10), r.Status, "", "", "", ""}
+	if r.Item != nil {
+		fields[2], fields[3], fields[4], fields[5] = r.Item.Filename, r.Item.Kind, strconv.FormatUint(r.Item.Size, 10), r.Item.Timestamp
+	}
+	return fields
+}
+
+// pasteResult is what was pasted, and where to.
+type pasteResult struct {
+	Id           uint32   `json:"id"`
+	Name         string   `json:"name,omitempty"`
+	Filename     string   `json:"filename,omitempty"`
+	Member       string   `json:"member,omitempty"`
+	Kind         string   `json:"kind"`
+	Size         uint64   `json:"size"`
+	Decompressed bool     `json:"decompressed,omitempty"`
+	Paths        []string `json:"paths,omitempty"` // files or directory written, empty for stdout
+}
+
+func (r pasteResult) tsvHeader() []string {
+	return []string{"id", "name", "filename", "member", "kind", "size", "decompressed", "paths"}
+}
+
+func (r pasteResult) tsvFields() []string {
+	return []string{
+		strconv.FormatUint(uint64(r.Id), 10), r.Name, r.Filename, r.Member, r.Kind,
+		strconv.FormatUint(r.Size, 10), strconv.FormatBool(r.Decompressed), strings.Join(r.Paths, ","),
+	}
+}
+
+// formatTime formats a time in RFC 3339, or "" if it is not set.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// parseFormat parses a --format template.
+func parseFormat(format string) (*template.Template, error) {
+	return template.New("format").Funcs(template.FuncMap{"join": strings.Join}).Parse(format)
+}
+
+// recordWriter writes records in the format asked for with --output, or
+// with the template given with --format.
+type recordWriter struct {
+	w       io.Writer
+	output  string
+	tmpl    *template.Template
+	records []record // for json, which is written as one array at the end
+	header  bool     // the TSV header has been written
+	single  bool     // there is only ever one record, so json is not an array
+}
+
+func (c *Client) newRecordWriter(w io.Writer) *recordWriter {
+	return &recordWriter{w: w, output: c.outputFormat, tmpl: c.format}
+}
+
+func (rw *recordWriter) write(r record) error {
+	switch {
+	case rw.tmpl != nil:
+		err := rw.tmpl.Execute(rw.w, r)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(rw.w)
+		return err
+	case rw.output == "json":
+		rw.records = append(rw.records, r)
+		return nil
+	case rw.output == "ndjson":
+		return json.NewEncoder(rw.w).Encode(r)
+	case rw.output == "tsv":
+		if !rw.header {
+			rw.header = true
+			_, err := fmt.Fprintln(rw.w, strings.Join(r.tsvHeader(), "\t"))
+			if err != nil {
+				return err
+			}
+		}
+		fields := r.tsvFields()
+		for i := range fields {
+			fields[i] = tsvEscape(fields[i])
+		}
+		_, err := fmt.Fprintln(rw.w, strings.Join(fields, "\t"))
+		return err
+	}
+	return fmt.Errorf("unknown output format '%s'", rw.output)
+}
+
+// close finishes writing the records.
+func (rw *recordWriter) close() error {
+	if rw.tmpl != nil || rw.output != "json" {
+		return nil
+	}
+	enc := json.NewEncoder(rw.w)
+	enc.SetIndent("", "  ")
+	if rw.single && len(rw.records) == 1 {
+		return enc.Encode(rw.records[0])
+	}
+	records := rw.records
+	if records == nil {
+		records = []record{}
+	}
+	return enc.Encode(records)
+}
+
+// tsvEscape escapes what would break a field in a TSV, as the
+// text/tab-separated-values type describes.
+func tsvEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`).Replace(s)
+}
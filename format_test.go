@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/tardisx/netgiv/secure"
+)
+
+func TestListItem(t *testing.T) {
+	c := Client{}
+	ts := time.Date(2026, 10, 19, 2, 13, 26, 500, time.UTC)
+	item := c.listItem(secure.PacketListData{
+		Id:         3,
+		FileSize:   5000000000,
+		StoredSize: 1200,
+		Timestamp:  ts,
+		Encryption: secure.EncryptionTeam | secure.EncryptionPassphrase,
+		Meta:       map[string]string{"b": "2", "a": "1"},
+	})
+	if item.Size != 5000000000 || item.Timestamp != "2026-10-19T02:13:26Z" || item.BurnedAt != "" {
+		t.Errorf("converted to %+v", item)
+	}
+	if len(item.Encryption) != 2 || item.Encryption[0] != "e2e" || item.Encryption[1] != "passphrase" {
+		t.Errorf("encryption is %v", item.Encryption)
+	}
+	if fields := item.tsvFields(); fields[12] != "a=1,b=2" || len(fields) != len(item.tsvHeader()) {
+		t.Errorf("tsv fields are %q", fields)
+	}
+}
+
+func TestRecordWriter(t *testing.T) {
+	items := []record{
+		listItem{Id: 1, Kind: "UTF-8 text", Size: 3, Note: "a\ttab\nand line"},
+		listItem{Id: 2, Filename: "b.png", Kind: "image/png", Size: 10},
+	}
+	write := func(c Client, records []record) string {
+		t.Helper()
+		buf := &bytes.Buffer{}
+		rw := c.newRecordWriter(buf)
+		for _, r := range records {
+			if err := rw.write(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := rw.close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	out := write(Client{outputFormat: "json"}, items)
+	decoded := []listItem{}
+	if err := json.Unmarshal([]byte(out), &decoded); err != nil || len(decoded) != 2 || decoded[1].Filename != "b.png" {
+		t.Errorf("json is %s", out)
+	}
+	if out := write(Client{outputFormat: "json"}, nil); out != "[]\n" {
+		t.Errorf("empty json is %q", out)
+	}
+
+	out = write(Client{outputFormat: "ndjson"}, items)
+	if lines := bytes.Count([]byte(out), []byte("\n")); lines != 2 {
+		t.Errorf("ndjson is %s", out)
+	}
+
+	out = write(Client{outputFormat: "tsv"}, items)
+	want := "id\tname\tversion\tfilename\tkind\tsize\tstored_size\ttimestamp\tburned_at\tencryption\tsigner_name\tlabels\tmeta\tnote\n" +
+		"1\t\t\t\tUTF-8 text\t3\t0\t\t\t\t\t\t\ta\\ttab\\nand line\n" +
+		"2\t\t\tb.png\timage/png\t10\t0\t\t\t\t\t\t\t\n"
+	if out != want {
+		t.Errorf("tsv is %q", out)
+	}
+
+	tmpl, err := parseFormat("{{.Id}} {{.Filename}} {{.Size}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := write(Client{format: tmpl}, items); out != "1  3\n2 b.png 10\n" {
+		t.Errorf("template output is %q", out)
+	}
+}
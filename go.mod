@@ -5,10 +5,12 @@ go 1.17
 require (
 	github.com/dustin/go-humanize v1.0.0
 	github.com/h2non/filetype v1.1.3
+	github.com/klauspost/compress v1.15.15
 	github.com/mattn/go-isatty v0.0.14
 	github.com/sirupsen/logrus v1.8.1
 	github.com/spf13/pflag v1.0.5
 	github.com/spf13/viper v1.10.1
+	github.com/ulikunitz/xz v0.5.12
 	golang.org/x/crypto v0.0.0-20220112180741-5e0467b6c7ce
 	golang.org/x/term v0.0.0-20210927222741-03fcf44c2211
 )
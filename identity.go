@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tardisx/netgiv/secure"
+)
+
+// loadKeyFile reads the base64 encoded private key from a key file, as
+// written by writeKeyFile.
+func loadKeyFile(path string) (*[32]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		return secure.ParseKey(line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("no key in %s", path)
+}
+
+// writeKeyFile writes a private key to a new key file, noting the public
+// key in a comment. It will not overwrite an existing file.
+func writeKeyFile(path string, publicKey []byte, privateKey []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "# created: %s\n# public key: %s\n%s\n", time.Now().Format(time.RFC3339), base64.StdEncoding.EncodeToString(publicKey), base64.StdEncoding.EncodeToString(privateKey))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// loadIdentity reads the X25519 private key, for decrypting data sent to
+// us, from an identity file.
+func loadIdentity(path string) (*[32]byte, error) {
+	return loadKeyFile(path)
+}
+
+// loadSigningKey reads the ed25519 private key, for signing data we send,
+// from a signing key file.
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	seed, err := loadKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.NewKeyFromSeed(seed[:]), nil
+}
+
+// keygen creates the identity and signing key files, if they do not
+// exist already, and shows the public keys.
+func keygen(identityPath string, signingKeyPath string, out io.Writer) error {
+	for _, path := range []string{identityPath, signingKeyPath} {
+		err := os.MkdirAll(filepath.Dir(path), 0o700)
+		if err != nil {
+			return err
+		}
+	}
+
+	identity, err := loadIdentity(identityPath)
+	if errors.Is(err, os.ErrNotExist) {
+		var pub *[32]byte
+		pub, identity = secure.GenerateIdentity()
+		err = writeKeyFile(identityPath, pub[:], identity[:])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "created identity in %s\n", identityPath)
+	} else if err != nil {
+		return fmt.Errorf("could not load identity: %v", err)
+	}
+	fmt.Fprintf(out, "public key (for --to): %s\n", base64.StdEncoding.EncodeToString(secure.IdentityPublicKey(identity)[:]))
+
+	signingKey, err := loadSigningKey(signingKeyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		var pub ed25519.PublicKey
+		pub, signingKey, err = ed25519.GenerateKey(nil)
+		if err != nil {
+			return err
+		}
+		err = writeKeyFile(signingKeyPath, pub, signingKey.Seed())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "created signing key in %s\n", signingKeyPath)
+	} else if err != nil {
+		return fmt.Errorf("could not load signing key: %v", err)
+	}
+	fmt.Fprintf(out, "signing public key (for trusted signers): %s\n", base64.StdEncoding.EncodeToString(signingKey.Public().(ed25519.PublicKey)))
+	return nil
+}
+
+// loadNamedKeys reads a file of named public keys, like the recipients
+// or trusted signers files.
+func loadNamedKeys(path string) ([]secure.NamedKey, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return secure.ParseNamedKeys(f)
+}
+
+// loadTrustedSigners reads the trusted signers file. It is fine for it
+// not to exist, then nobody is trusted.
+func loadTrustedSigners(path string) ([]secure.NamedKey, error) {
+	signers, err := loadNamedKeys(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return []secure.NamedKey{}, nil
+	}
+	return signers, err
+}
+
+// signerName returns the name of a trusted signer by public key, or an
+// empty string if they are not trusted.
+func signerName(trusted []secure.NamedKey, publicKey []byte) string {
+	for _, signer := range trusted {
+		if bytes.Equal(signer.PublicKey[:], publicKey) {
+			return signer.Name
+		}
+	}
+	return ""
+}
+
+// lookupRecipients returns the named recipients from a recipients file.
+func lookupRecipients(path string, names []string) ([]secure.NamedKey, error) {
+	known, err := loadNamedKeys(path)
+	if err != nil {
+		return nil, err
+	}
+
+	recipients := []secure.NamedKey{}
+NAMES:
+	for _, name := range names {
+		for _, r := range known {
+			if r.Name == name {
+				recipients = append(recipients, r)
+				continue NAMES
+			}
+		}
+		return nil, fmt.Errorf("recipient '%s' is not in %s", name, path)
+	}
+	return recipients, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/h2non/filetype"
+)
+
+// kindSniffSize is how much of the start of the data detectKind wants to
+// see. filetype.Match needs a few hundred bytes.
+const kindSniffSize = 512
+
+// detectKind returns a description of the kind of data, based on the
+// first few hundred bytes of it, or an empty string if it is unknown.
+func detectKind(data []byte) string {
+	kind, _ := filetype.Match(data)
+	if kind.MIME.Value != "" {
+		return kind.MIME.Value
+	}
+
+	// this is pretty fragile. If our chunk boundary happens in the
+	// middle of an actual UTF-8 character, we will fail this test.
+	// However it's good for small chunks of text which fit in a
+	// single chunk, which I suspect to be a common use case.
+	if utf8.Valid(data) {
+		return "UTF-8 text"
+	}
+	return ""
+}
+
+// compressedKind returns true if data of the kind is already compressed,
+// so there is no point compressing it again.
+func compressedKind(kind string) bool {
+	switch {
+	case strings.HasPrefix(kind, "video/"):
+		return true
+	case strings.HasPrefix(kind, "audio/") && kind != "audio/x-wav":
+		return true
+	case strings.HasPrefix(kind, "application/vnd.openxmlformats-officedocument."):
+		// office documents are zip files
+		return true
+	}
+	switch kind {
+	case "application/gzip", "application/zip", "application/x-bzip2", "application/x-xz",
+		"application/zstd", "application/x-7z-compressed", "application/vnd.rar",
+		"application/x-lzip", "application/x-compress", "application/epub+zip",
+		"application/vnd.ms-cab-compressed", "application/x-rpm", "application/vnd.debian.binary-package",
+		"image/jpeg", "image/png", "image/gif", "image/webp", "image/heif", "image/avif", "image/jp2":
+		return true
+	}
+	return false
+}
+
+// compressibleKind returns true if data of the kind usually compresses
+// well. Unknown kinds are assumed not to.
+func compressibleKind(kind string) bool {
+	switch kind {
+	case "UTF-8 text", "application/x-tar", "application/vnd.sqlite3", "application/rtf",
+		"application/postscript", "application/msword", "application/vnd.ms-excel",
+		"application/vnd.ms-powerpoint", "application/x-executable", "application/x-mach-binary",
+		"application/vnd.microsoft.portable-executable", "application/wasm", "application/x-unix-archive",
+		"application/x-iso9660-image", "application/dicom", "audio/x-wav", "audio/x-aiff",
+		"image/bmp", "image/tiff", "image/vnd.adobe.photoshop":
+		return true
+	}
+	return false
+}
+
+// kindMIME returns the kind as a MIME type, for kinds which are not
+// described by one.
+func kindMIME(kind string) string {
+	if kind == "UTF-8 text" {
+		return "text/plain"
+	}
+	return kind
+}
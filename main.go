@@ -1,9 +1,14 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"text/template"
 
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/term"
@@ -11,17 +16,38 @@ import (
 	"github.com/mattn/go-isatty"
 	flag "github.com/spf13/pflag"
 	"github.com/spf13/viper"
+
+	"github.com/tardisx/netgiv/secure"
+	"github.com/tardisx/netgiv/storage"
 )
 
-const ProtocolVersion = "1.1"
+const ProtocolVersion = "1.3"
 
+// ListValue is an item id, or the name of an item, optionally with a
+// version, or a selector, or a list of ids, given to a flag.
 type ListValue struct {
 	Required bool
 	Number   uint
+	Name     string
+	Version  uint32
+	Selector *secure.Selector
+	Ids      []uint32
 }
 
 func (v *ListValue) String() string {
 	if v.Required {
+		if v.Selector != nil {
+			return fmt.Sprintf("YES: %+v", *v.Selector)
+		}
+		if v.Ids != nil {
+			return fmt.Sprintf("YES: %v", v.Ids)
+		}
+		if v.Name != "" && v.Version != 0 {
+			return fmt.Sprintf("YES: %s@%d", v.Name, v.Version)
+		}
+		if v.Name != "" {
+			return fmt.Sprintf("YES: %s", v.Name)
+		}
 		return fmt.Sprintf("YES: %d", v.Number)
 	}
 	return "0"
@@ -29,40 +55,99 @@ func (v *ListValue) String() string {
 
 func (v *ListValue) Set(s string) error {
 	v.Required = true
-	num, err := strconv.ParseUint(s, 10, 64)
+	if isSelector(s) {
+		sel, err := parseSelector(s)
+		if err != nil {
+			return err
+		}
+		v.Selector = sel
+		return nil
+	}
+	if strings.Contains(s, ",") {
+		ids, err := parseIds(s)
+		if err != nil {
+			return err
+		}
+		v.Ids = ids
+		return nil
+	}
+	num, err := strconv.ParseUint(s, 10, 32)
 	if err != nil {
-		return err
+		name, version, nameErr := parseVersion(s)
+		if nameErr != nil {
+			return fmt.Errorf("not an id or a name: %v", nameErr)
+		}
+		v.Name, v.Version = name, version
+		return nil
 	}
 
 	v.Number = uint(num)
 	return nil
 }
 
+// takeArg takes the value from the first of args, if the flag was given
+// without one and that is an id or a name, and returns the rest of them.
+func (v *ListValue) takeArg(args []string) []string {
+	if !v.Required || v.Number != 0 || v.Name != "" || v.Selector != nil || v.Ids != nil || len(args) == 0 {
+		return args
+	}
+	if err := v.Set(args[0]); err != nil {
+		if isSelector(args[0]) || strings.Contains(args[0], ",") {
+			log.Fatal(err)
+		}
+		return args
+	}
+	return args[1:]
+}
+
+// parseIds parses a list of ids separated by commas.
+func parseIds(s string) ([]uint32, error) {
+	ids := []uint32{}
+	for _, id := range strings.Split(s, ",") {
+		num, err := strconv.ParseUint(id, 10, 32)
+		if err != nil || num == 0 {
+			return nil, fmt.Errorf("bad id '%s' in list", id)
+		}
+		ids = append(ids, uint32(num))
+	}
+	return ids, nil
+}
+
 func (v *ListValue) Type() string {
 	return "int"
 }
 
-func getAuthTokenFromTerminal() string {
+// readSecretFromTerminal prompts for a secret on /dev/tty, and reads it
+// without echoing it to the screen.
+func readSecretFromTerminal(prompt string) (string, error) {
 	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0o755)
 	if err != nil {
-		log.Printf("cannot open /dev/tty to read authtoken: %v", err)
-		return ""
+		return "", fmt.Errorf("cannot open /dev/tty: %v", err)
 	}
+	defer tty.Close()
 	fd := int(tty.Fd())
 
 	oldState, err := term.MakeRaw(fd)
 	if err != nil {
-		log.Printf("cannot set /dev/tty to raw mode: %v", err)
-		return ""
+		return "", fmt.Errorf("cannot set /dev/tty to raw mode: %v", err)
 	}
 	defer func() {
 		_ = term.Restore(fd, oldState)
 	}()
 
 	t := term.NewTerminal(tty, "")
-	pass, err := t.ReadPassword("Enter auth token: ")
+	secret, err := t.ReadPassword(prompt)
+	if err != nil {
+		return "", fmt.Errorf("cannot read from /dev/tty: %v", err)
+	}
+
+	return secret, nil
+}
+
+func getAuthTokenFromTerminal() string {
+	pass, err := readSecretFromTerminal("Enter auth token: ")
 	if err != nil {
-		log.Printf("cannot read password from /dev/tty: %v", err)
+		log.Printf("cannot read authtoken: %v", err)
 		return ""
 	}
 
@@ -80,15 +165,47 @@ func main() {
 
 	// client mode flags
 	isList := flag.BoolP("list", "l", false, "Returns a list of current items on the server")
-	isSend := flag.BoolP("copy", "c", false, "send stdin to netgiv server (copy)")
+	isSend := flag.BoolP("copy", "c", false, "send stdin, or the files given, to netgiv server (copy)")
+	flag.Bool("e2e", false, "encrypt the data sent with the team secret, so the server cannot read it")
+	isPassphrase := flag.Bool("passphrase", false, "lock the data sent with a passphrase, which will be prompted for")
+	to := flag.StringSlice("to", nil, "encrypt the data sent to these recipients, from the recipients file (see --help-config)")
+	labels := flag.StringArray("label", nil, "with --copy, label the item, can be given more than once (see --filter)")
+	meta := flag.StringArray("meta", nil, "with --copy, add metadata to the item as key=value, can be given more than once (see --filter)")
+	note := flag.String("note", "", "with --copy, add a note to the item, shown by --info")
+	name := flag.String("name", "", "with --copy, copy to this name, replacing the item with that name, which can then be used instead of an id")
+	isKeygen := flag.Bool("keygen", false, "create an identity for receiving data sent with --to, and a key for signing data, and show their public keys")
+	flag.Bool("sign", false, "sign the data sent with your signing key, so others can verify it came from you")
 
 	pasteFlag := ListValue{}
-	flag.VarP(&pasteFlag, "paste", "p", "receive from netgiv server to stdout (paste), with optional id (see --list)")
+	flag.VarP(&pasteFlag, "paste", "p", "receive from netgiv server to stdout (paste), with optional id or name, NAME@VERSION for an older version (see --list and --history), or a selector like ~1 or kind:image/png for the newest matching")
 	flag.Lookup("paste").NoOptDefVal = "0"
+	output := flag.StringP("output-file", "o", "", "with --paste, write to this file instead of stdout, or into this directory under the name it was sent with")
+	isForce := flag.Bool("force", false, "with --output-file, overwrite the file if it already exists")
+	isNoPreserve := flag.Bool("no-preserve", false, "with --output-file, do not set the file's mode and modification time to those of the file copied")
+	member := flag.String("member", "", "with --paste, paste just this file of an item copied from several files")
+	isDecompress := flag.Bool("decompress", false, "with --paste, decompress gzip, bzip2, xz or zstd data before writing it out")
 
 	burnFlag := ListValue{}
-	flag.VarP(&burnFlag, "burn", "b", "burn (remove/delete) the item on the netgiv server, with optional id (see --list)")
+	flag.VarP(&burnFlag, "burn", "b", "burn (remove/delete) the item on the netgiv server, with optional id or name (see --list), a list of ids like 3,4,7, or a selector like before:1d or all for every item matching")
+	isDryRun := flag.Bool("dry-run", false, "with --burn, list what would be burned, without burning it")
 	flag.Lookup("burn").NoOptDefVal = "0"
+	isPurge := flag.Bool("purge", false, "with --burn, delete the item permanently instead of moving it to the trash")
+
+	infoFlag := ListValue{}
+	flag.Var(&infoFlag, "info", "show the details of an item, with optional id or name (see --list)")
+	flag.Lookup("info").NoOptDefVal = "0"
+
+	history := flag.String("history", "", "list the versions kept of the item with this name")
+	rollback := flag.String("rollback", "", "make the previous version of the item with this name current again, or the version given as NAME@VERSION (see --history)")
+
+	filter := flag.StringSlice("filter", nil, "with --list or --trash, list only the items matching all of these key=pattern conditions, where the key is label, kind, name, filename, note or a metadata key")
+	isTrash := flag.Bool("trash", false, "Returns a list of burned items in the trash on the server")
+	restoreFlag := ListValue{}
+	flag.Var(&restoreFlag, "restore", "restore a burned item from the trash, with optional id or name (see --trash)")
+	flag.Lookup("restore").NoOptDefVal = "0"
+
+	outputFormat := flag.String("output", "", "with --list, --trash, --history, --paste or --burn, write the results for scripts, as json, ndjson or tsv")
+	format := flag.String("format", "", "with --list, --trash, --history, --paste or --burn, write each result with this Go template, like '{{.Id}} {{.Filename}}'")
 
 	debug := flag.Bool("debug", false, "turn on debug logging")
 	flag.String("address", "", "IP address/hostname of the netgiv server")
@@ -108,6 +225,14 @@ func main() {
 		os.Exit(0)
 	}
 
+	// pflag only takes the optional value of a flag like --paste when it is
+	// given as --paste=3 or -p3, so pick up "-p 3" from the arguments
+	args := flag.Args()
+	args = pasteFlag.takeArg(args)
+	args = burnFlag.takeArg(args)
+	args = restoreFlag.takeArg(args)
+	args = infoFlag.takeArg(args)
+
 	receiveNum := int(pasteFlag.Number)
 	if !pasteFlag.Required {
 		receiveNum = -1
@@ -118,11 +243,45 @@ func main() {
 		burnNum = -1
 	}
 
+	restoreNum := int(restoreFlag.Number)
+	if !restoreFlag.Required {
+		restoreNum = -1
+	}
+
+	for _, v := range []*ListValue{&pasteFlag, &restoreFlag, &infoFlag} {
+		if v.Ids != nil {
+			log.Fatal("only --burn can be given a list of ids")
+		}
+	}
+
+	infoNum := int(infoFlag.Number)
+	if !infoFlag.Required {
+		infoNum = -1
+	}
+
 	viper.AddConfigPath("$HOME/.netgiv/")
 	viper.AddConfigPath("$HOME/.config/netgiv/") // calling multiple times adds to search paths
 	viper.SetConfigType("yaml")
 
 	viper.SetDefault("port", 4512)
+	viper.SetDefault("trash_retention", "24h")
+	viper.SetDefault("versions", 5)
+	viper.SetDefault("storage_dir", defaultStorageDir())
+	viper.SetDefault("storage", "filesystem")
+	viper.SetDefault("orphans", "delete")
+	viper.SetDefault("s3_region", "us-east-1")
+	viper.SetDefault("s3_path_style", true)
+	viper.SetDefault("shutdown_timeout", "30s")
+	viper.SetDefault("persist", false)
+	viper.SetDefault("compress", true)
+	viper.SetDefault("compress_storage", true)
+	if home, err := os.UserHomeDir(); err == nil {
+		viper.SetDefault("identity_file", filepath.Join(home, ".netgiv", "identity"))
+		viper.SetDefault("recipients_file", filepath.Join(home, ".netgiv", "recipients"))
+		viper.SetDefault("signing_key_file", filepath.Join(home, ".netgiv", "signing_key"))
+		viper.SetDefault("trusted_signers_file", filepath.Join(home, ".netgiv", "trusted_signers"))
+	}
+	viper.SetDefault("verify_signatures", "warn")
 
 	if err := viper.ReadInConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
@@ -141,6 +300,7 @@ func main() {
 	// pull the various things into local variables
 	port := viper.GetInt("port") // retrieve value from viper
 	authtoken := viper.GetString("authtoken")
+	teamSecret := viper.GetString("team_secret")
 
 	address := viper.GetString("address")
 
@@ -164,6 +324,90 @@ port: 5412
 authtoken: verysecretvaluehere
 address: 10.1.12.20
 
+On the server, burned items are kept in the trash (see --trash and --restore)
+for 24 hours before being deleted. This can be changed with the 'trash_retention'
+key, which takes a duration like '30m' or '72h'. Setting it to 0 disables the
+trash, so burned items are deleted immediately.
+
+When an item is copied to a name already in use, the previous item becomes an
+older version of the name (see --history and --rollback). The server keeps the
+last 5 versions of each name, besides the current one, which can be changed with
+the 'versions' key. Every version kept takes up space in storage, just as a
+listed item does, so set it to 0 to keep none.
+
+The server stores items in the directory given by the 'storage_dir' key, which
+defaults to a 'netgiv' directory in your user cache dir (such as ~/.cache). On
+startup, any files in there left behind by a previous server which crashed or was
+killed are deleted, so it should not be shared with another server. Set the 'orphans' key to 'quarantine' to move them into a 'quarantine'
+subdirectory instead.
+
+Set the 'storage' key to 'memory' to keep items in memory instead (optionally
+limiting the size of each item in bytes with 'memory_max_size'), or to 's3' to
+store them in an S3 compatible object store, configured with these keys:
+
+s3_endpoint: http://minio.local:9000
+s3_bucket: netgiv
+s3_region: us-east-1       # the default
+s3_access_key: ...
+s3_secret_key: ...
+s3_prefix: items/          # optional, prepended to object names
+s3_path_style: true        # the default, set to false for AWS style bucket hostnames
+
+Stored items can be encrypted by setting the 'master_key' key to a random 32 byte
+key, base64 encoded (for example, the output of 'head -c 32 /dev/urandom | base64').
+Each item is encrypted with its own key, which is stored alongside it, encrypted by
+the master key.
+
+To be able to rotate the master key, use 'master_key_file' instead, pointing at a
+file containing one key per line, each preceded by a name:
+
+  2025-06 QmFzZTY0IGVuY29kZWQgMzIgYnl0ZSBrZXkgaGVyZSE=
+  default S2VlcCBvbGQga2V5cyB1bnRpbCBpdGVtcyBhcmUgZ29uZQ==
+
+New items use the first key, and any key in the file can decrypt. A 'master_key'
+has the name 'default', so it can be moved into a key file as shown.
+
+When the server receives SIGINT or SIGTERM it stops accepting connections and
+waits for transfers in progress to finish, for up to 'shutdown_timeout' (default
+'30s'). Stored items are then deleted, unless the 'persist' key is set to true,
+in which case they are kept and will be available again when the server restarts.
+
+Data is always encrypted on the way to and from the server, but the server itself
+can read it. To prevent that, set the 'e2e' key to true (or use the --e2e flag) on
+the client, and data will be encrypted before it is sent, with a key derived from
+the 'team_secret' key (or the authtoken, if that is not set). Anyone pasting it
+will need the same team secret.
+
+To send data that only particular people can read, each of them runs 'netgiv
+--keygen', which creates an identity file (by default ~/.netgiv/identity, set with
+the 'identity_file' key) and shows its public key. Collect the public keys in a
+recipients file (by default ~/.netgiv/recipients, set with the 'recipients_file'
+key), one per line, each preceded by a name:
+
+  alice 3pTq3pG1Bk8lE2BqvYqYdFUEdz6Fh0MI3kS3pXZ7Xj4=
+  bob   Yk1lUq0lEJr8KQbWcHMFXTzXH8C2Qq3gqH+xJ3T0pQM=
+
+then use '--to alice,bob' when copying. The item can only be pasted by someone
+with one of the matching identities.
+
+To show who sent an item, set the 'sign' key to true (or use the --sign flag) and
+items will be signed with the key in the signing key file (by default
+~/.netgiv/signing_key, set with the 'signing_key_file' key), which is also created
+by --keygen. When pasting, signatures are checked against the public keys in the
+trusted signers file (by default ~/.netgiv/trusted_signers, set with the
+'trusted_signers_file' key), which is in the same format as the recipients file.
+A bad signature is always an error. Items signed by someone who is not trusted
+produce a warning, unless the 'verify_signatures' key is set to 'require', in which
+case they are an error, as are items which are not signed at all.
+
+Data is compressed on the way to and from the server, unless it is already
+compressed (or encrypted by the client). To turn this off, set the 'compress' key
+to false, on either the client or the server.
+
+The server also compresses items it stores, if they are text or another kind
+which compresses well, and at least 1 KiB. Set the 'compress_storage' key to
+false to turn this off.
+
 Note that it is possible to set/override the authtoken by setting the NETGIV_AUTHTOKEN
 environment variable. This may be preferable in some environments.
 
@@ -176,6 +420,14 @@ environment variable. This may be preferable in some environments.
 		log.SetLevel(log.DebugLevel)
 	}
 
+	if *isKeygen {
+		err := keygen(viper.GetString("identity_file"), viper.GetString("signing_key_file"), os.Stdout)
+		if err != nil {
+			log.Fatalf("could not create keys: %v", err)
+		}
+		os.Exit(0)
+	}
+
 	// if still no authtoken and in client mode, try from the terminal, last
 	// ditch effort
 	if !*isServer && authtoken == "" {
@@ -192,16 +444,44 @@ environment variable. This may be preferable in some environments.
 
 	log.Debugf("protocol version: %s", ProtocolVersion)
 	if *isServer {
-		s := Server{port: port, authToken: authtoken}
+		backend, err := storageBackend()
+		if err != nil {
+			log.Fatalf("could not set up storage: %v", err)
+		}
+		keyring, err := masterKeyring()
+		if err != nil {
+			log.Fatalf("could not load master key: %v", err)
+		}
+		if keyring != nil {
+			log.Debugf("encrypting stored items")
+			backend = &storage.Encrypted{Backend: backend, Keyring: keyring}
+		}
+
+		s := Server{
+			port:            port,
+			authToken:       authtoken,
+			trashRetention:  viper.GetDuration("trash_retention"),
+			versions:        viper.GetInt("versions"),
+			storageDir:      viper.GetString("storage_dir"),
+			backend:         backend,
+			orphans:         viper.GetString("orphans"),
+			shutdownTimeout: viper.GetDuration("shutdown_timeout"),
+			persist:         viper.GetBool("persist"),
+			compress:        viper.GetBool("compress"),
+			compressStorage: viper.GetBool("compress_storage"),
+		}
 		s.Run()
 	} else {
-		if !*isList && !*isSend && burnNum == -1 && receiveNum == -1 {
+		if !*isList && !*isTrash && !*isSend && burnNum == -1 && restoreNum == -1 && receiveNum == -1 && infoNum == -1 && *history == "" && *rollback == "" {
 			// try to work out the intent based on whether or not stdin/stdout
 			// are ttys
 			stdinTTY := isatty.IsTerminal(os.Stdin.Fd())
 			stdoutTTY := isatty.IsTerminal(os.Stdout.Fd())
 
-			if stdinTTY && !stdoutTTY {
+			if len(args) > 0 {
+				// a file to send
+				*isSend = true
+			} else if *output != "" || (stdinTTY && !stdoutTTY) {
 				receiveNum = 0
 			} else if !stdinTTY && stdoutTTY {
 				*isSend = true
@@ -214,12 +494,168 @@ environment variable. This may be preferable in some environments.
 
 		}
 
-		c := Client{port: port, address: address, list: *isList, send: *isSend, burnNum: burnNum, receiveNum: receiveNum, authToken: authtoken}
-		err := c.Connect()
+		inputs := []string{}
+		if *isSend {
+			inputs = args
+			args = nil
+		}
+		if len(args) > 0 {
+			log.Fatalf("unexpected arguments: %s", strings.Join(args, " "))
+		}
+		if *name != "" {
+			if err := validName(*name); err != nil {
+				log.Fatalf("cannot copy to '%s': %v", *name, err)
+			}
+		}
+		metadata := map[string]string{}
+		for _, m := range *meta {
+			key, value, err := parseMeta(m)
+			if err != nil {
+				log.Fatal(err)
+			}
+			metadata[key] = value
+		}
+		if len(metadata) == 0 {
+			metadata = nil
+		}
+		if err := validMetadata(*labels, metadata, *note); err != nil {
+			log.Fatalf("cannot copy: %v", err)
+		}
+		listFilter, err := parseFilter(*filter)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var formatTemplate *template.Template
+		if *outputFormat != "" || *format != "" {
+			if *isSend || infoNum >= 0 || *rollback != "" {
+				log.Fatal("--output and --format only work with --list, --trash, --history, --paste and --burn")
+			}
+			if *outputFormat != "" && *format != "" {
+				log.Fatal("only one of --output and --format can be given")
+			}
+			known := false
+			for _, f := range outputFormats {
+				known = known || f == *outputFormat
+			}
+			if *outputFormat != "" && !known {
+				log.Fatalf("--output must be one of %s", strings.Join(outputFormats, ", "))
+			}
+			if *format != "" {
+				formatTemplate, err = parseFormat(*format)
+				if err != nil {
+					log.Fatalf("bad --format: %v", err)
+				}
+			}
+		}
+		if *history != "" {
+			if err := validName(*history); err != nil {
+				log.Fatalf("no history for '%s': %v", *history, err)
+			}
+		}
+		rollbackName, rollbackVersion := "", uint32(0)
+		if *rollback != "" {
+			var err error
+			rollbackName, rollbackVersion, err = parseVersion(*rollback)
+			if err != nil {
+				log.Fatalf("cannot roll back to '%s': %v", *rollback, err)
+			}
+		}
+
+		if teamSecret == "" {
+			teamSecret = authtoken
+		}
+
+		recipients := []secure.NamedKey{}
+		if len(*to) > 0 {
+			var err error
+			recipients, err = lookupRecipients(viper.GetString("recipients_file"), *to)
+			if err != nil {
+				log.Fatalf("could not find recipients: %v", err)
+			}
+		}
+
+		var signingKey ed25519.PrivateKey
+		if viper.GetBool("sign") && *isSend {
+			var err error
+			signingKey, err = loadSigningKey(viper.GetString("signing_key_file"))
+			if err != nil {
+				log.Fatalf("could not load signing key (see --keygen): %v", err)
+			}
+		}
+		trustedSigners, err := loadTrustedSigners(viper.GetString("trusted_signers_file"))
+		if err != nil {
+			log.Fatalf("could not load trusted signers: %v", err)
+		}
+		verify := viper.GetString("verify_signatures")
+		if verify != "warn" && verify != "require" {
+			log.Fatalf("verify_signatures must be 'warn' or 'require', not '%s'", verify)
+		}
+
+		c := Client{compress: viper.GetBool("compress"), signingKey: signingKey, trustedSigners: trustedSigners, requireSignature: verify == "require", to: recipients, identity: viper.GetString("identity_file"), e2e: viper.GetBool("e2e"), teamSecret: teamSecret, lock: *isPassphrase, port: port, address: address, list: *isList, trash: *isTrash, send: *isSend, inputs: inputs, name: *name, labels: *labels, meta: metadata, note: *note, filter: listFilter, burnNum: burnNum, burnName: burnFlag.Name, burnVersion: burnFlag.Version, burnSelector: burnFlag.Selector, burnIds: burnFlag.Ids, dryRun: *isDryRun, outputFormat: *outputFormat, format: formatTemplate, purge: *isPurge, restoreNum: restoreNum, restoreName: restoreFlag.Name, restoreVersion: restoreFlag.Version, restoreSelector: restoreFlag.Selector, receiveNum: receiveNum, receiveName: pasteFlag.Name, receiveVersion: pasteFlag.Version, receiveSelector: pasteFlag.Selector, member: *member, infoNum: infoNum, infoName: infoFlag.Name, infoVersion: infoFlag.Version, infoSelector: infoFlag.Selector, historyName: *history, rollbackName: rollbackName, rollbackVersion: rollbackVersion, decompress: *isDecompress, output: *output, force: *isForce, preserve: !*isNoPreserve, authToken: authtoken}
+		err = c.Connect()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// defaultStorageDir returns where the server stores items unless the
+// 'storage_dir' key says otherwise. It is a directory of the user's own,
+// rather than one shared with other users' servers, whose files would be
+// swept up as orphans on startup.
+func defaultStorageDir() string {
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "netgiv")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("netgiv-%d", os.Getuid()))
+}
+
+// storageBackend returns the storage backend chosen by the 'storage' key.
+func storageBackend() (storage.Backend, error) {
+	switch viper.GetString("storage") {
+	case "filesystem":
+		return storage.NewFilesystem(viper.GetString("storage_dir"))
+	case "memory":
+		return storage.NewMemory(viper.GetInt64("memory_max_size")), nil
+	case "s3":
+		s3 := &storage.S3{
+			Endpoint:  viper.GetString("s3_endpoint"),
+			Bucket:    viper.GetString("s3_bucket"),
+			Region:    viper.GetString("s3_region"),
+			AccessKey: viper.GetString("s3_access_key"),
+			SecretKey: viper.GetString("s3_secret_key"),
+			Prefix:    viper.GetString("s3_prefix"),
+			PathStyle: viper.GetBool("s3_path_style"),
+		}
+		if s3.Endpoint == "" || s3.Bucket == "" {
+			return nil, errors.New("s3_endpoint and s3_bucket must be set for s3 storage")
+		}
+		return s3, nil
+	default:
+		return nil, fmt.Errorf("unknown storage type '%s'", viper.GetString("storage"))
+	}
+}
+
+// masterKeyring returns the keyring for encrypting stored items, from the
+// 'master_key_file' or 'master_key' keys, or nil if neither is set.
+func masterKeyring() (*secure.Keyring, error) {
+	if path := viper.GetString("master_key_file"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return secure.ParseKeyring(f)
+	}
+	if viper.GetString("master_key") != "" {
+		key, err := secure.ParseKey(viper.GetString("master_key"))
 		if err != nil {
-			fmt.Print(err)
+			return nil, err
 		}
+		return secure.NewKeyring("default", key), nil
 	}
+	return nil, nil
 }
 
 func versionInfo(verbose bool) string {
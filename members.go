@@ -0,0 +1,346 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/tardisx/netgiv/secure"
+)
+
+// An item can be sent from several files at once, which are its members.
+// Their data is sent, and stored, one after the other, with a manifest of
+// their names and sizes so that they can be told apart again.
+
+const (
+	// the most files an item can be sent from, as the manifest of its
+	// members has to be sent in one message
+	maxMembers = 50
+	// the longest the kind of a member can be
+	maxMemberKindLength = 64
+)
+
+// cleanMembers returns the members sent by a client, fit to be stored.
+func cleanMembers(members []secure.Member) []secure.Member {
+	if len(members) == 0 {
+		return nil
+	}
+	out := make([]secure.Member, 0, len(members))
+	for _, m := range members {
+		out = append(out, secure.Member{
+			Name:    cleanFilename(m.Name),
+			Size:    m.Size,
+			Kind:    m.Kind,
+			Mode:    m.Mode & uint32(os.ModePerm),
+			ModTime: m.ModTime,
+		})
+	}
+	return out
+}
+
+// validMembers returns an error if an item can't be made of these members.
+func validMembers(members []secure.Member) error {
+	if len(members) > maxMembers {
+		return fmt.Errorf("can't send more than %d files together", maxMembers)
+	}
+	for _, m := range members {
+		if m.Name == "" {
+			return errors.New("a file has no name")
+		}
+		if len(m.Name) > maxNameLength {
+			return fmt.Errorf("file name '%s' is too long", m.Name)
+		}
+		if len(m.Kind) > maxMemberKindLength {
+			return fmt.Errorf("kind of '%s' is too long", m.Name)
+		}
+	}
+	return nil
+}
+
+// describable returns an error if the info on the NGF, with its labels,
+// metadata, note and members, would be too much to send in one message.
+func (ngf NGF) describable() error {
+	if !secure.Fits(ngf.infoData()) {
+		return errors.New("labels, metadata, note and files are too much to describe in one item")
+	}
+	return nil
+}
+
+// addMemberDigests adds the digests of the members sent at the end of an
+// upload, and makes sure the members account for all of the data, when
+// the data is not encrypted by the client so that can be checked.
+func (ngf *NGF) addMemberDigests(digests [][]byte) error {
+	if len(digests) != len(ngf.Members) {
+		return fmt.Errorf("%d digests for %d members", len(digests), len(ngf.Members))
+	}
+	total := uint64(0)
+	for i := range ngf.Members {
+		ngf.Members[i].Digest = digests[i]
+		total += ngf.Members[i].Size
+	}
+	if len(ngf.Members) > 0 && ngf.Encryption == 0 && total != ngf.Size {
+		return fmt.Errorf("members add up to %d bytes, not %d", total, ngf.Size)
+	}
+	return nil
+}
+
+// findMember returns the member called name, and where its data starts.
+func findMember(members []secure.Member, name string) (secure.Member, uint64, bool) {
+	offset := uint64(0)
+	for _, m := range members {
+		if m.Name == name {
+			return m, offset, true
+		}
+		offset += m.Size
+	}
+	return secure.Member{}, 0, false
+}
+
+// memberNames returns the names of the members.
+func memberNames(members []secure.Member) []string {
+	var names []string
+	for _, m := range members {
+		names = append(names, m.Name)
+	}
+	return names
+}
+
+// memberReader reads the files to send as the members of an item, one
+// after the other, working out the digest of each as it goes.
+type memberReader struct {
+	files   []*os.File
+	members []secure.Member
+	current int       // the member being read
+	left    uint64    // how much of it there is still to read
+	hash    hash.Hash // of the member being read
+}
+
+// openMembers opens the files to send as members. Each is sent as it is
+// when it is opened, and it is an error if one gets any shorter.
+func openMembers(paths []string) (*memberReader, error) {
+	if len(paths) > maxMembers {
+		return nil, fmt.Errorf("can't send more than %d files together", maxMembers)
+	}
+	r := &memberReader{hash: sha256.New()}
+	seen := map[string]bool{}
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.files = append(r.files, f)
+		info, err := f.Stat()
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		if !info.Mode().IsRegular() {
+			r.Close()
+			return nil, fmt.Errorf("%s is not a file, only files can be sent together", p)
+		}
+		name := filepath.Base(p)
+		if seen[name] {
+			r.Close()
+			return nil, fmt.Errorf("more than one file is called %s", name)
+		}
+		seen[name] = true
+		head := make([]byte, kindSniffSize)
+		n, _ := f.ReadAt(head, 0)
+		r.members = append(r.members, secure.Member{
+			Name:    name,
+			Size:    uint64(info.Size()),
+			Kind:    detectKind(head[:n]),
+			Mode:    uint32(info.Mode().Perm()),
+			ModTime: info.ModTime(),
+		})
+	}
+	if err := validMembers(r.members); err != nil {
+		r.Close()
+		return nil, err
+	}
+	if len(r.members) > 0 {
+		r.left = r.members[0].Size
+	}
+	return r, nil
+}
+
+func (r *memberReader) Read(p []byte) (int, error) {
+	for r.left == 0 {
+		if r.current == len(r.members) {
+			return 0, io.EOF
+		}
+		r.members[r.current].Digest = r.hash.Sum(nil)
+		r.hash.Reset()
+		r.current++
+		if r.current < len(r.members) {
+			r.left = r.members[r.current].Size
+		}
+	}
+	if uint64(len(p)) > r.left {
+		p = p[:r.left]
+	}
+	n, err := r.files[r.current].Read(p)
+	r.hash.Write(p[:n])
+	r.left -= uint64(n)
+	if err == io.EOF {
+		if r.left > 0 {
+			return n, fmt.Errorf("%s got shorter while it was being sent", r.files[r.current].Name())
+		}
+		err = nil
+	}
+	return n, err
+}
+
+// digests returns the digest of each member, once they have all been read.
+func (r *memberReader) digests() [][]byte {
+	digests := [][]byte{}
+	for _, m := range r.members {
+		digests = append(digests, m.Digest)
+	}
+	return digests
+}
+
+func (r *memberReader) Close() error {
+	var err error
+	for _, f := range r.files {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// skipReader reads from r, after skipping the first skip bytes.
+type skipReader struct {
+	r    io.Reader
+	skip int64
+}
+
+func (s *skipReader) Read(p []byte) (int, error) {
+	if s.skip > 0 {
+		n, err := io.CopyN(io.Discard, s.r, s.skip)
+		s.skip -= n
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return s.r.Read(p)
+}
+
+// memberFiles writes the data of the members of an item to a file for
+// each of them, in a directory.
+type memberFiles struct {
+	members  []secure.Member
+	files    []*atomicFile
+	current  int    // the member being written
+	left     uint64 // how much of it there is still to write
+	preserve bool   // set the mode and time of the files to those of the members
+}
+
+// newMemberFiles starts writing the members of an item to files in dir,
+// which is created if need be. Unless force is set, it is an error for
+// any of them to exist already.
+func newMemberFiles(dir string, members []secure.Member, force bool, preserve bool) (*memberFiles, error) {
+	if info, err := os.Stat(dir); err == nil && !info.IsDir() {
+		return nil, fmt.Errorf("item is made of several files, which can only be written to a directory, not %s", dir)
+	}
+	err := os.MkdirAll(dir, 0o777)
+	if err != nil {
+		return nil, err
+	}
+	w := &memberFiles{members: members, preserve: preserve}
+	for _, m := range members {
+		name := cleanFilename(m.Name)
+		if name == "" {
+			w.Abort()
+			return nil, fmt.Errorf("item has a file without a name")
+		}
+		f, err := createAtomic(filepath.Join(dir, name), force)
+		if err != nil {
+			w.Abort()
+			return nil, err
+		}
+		w.files = append(w.files, f)
+	}
+	if len(members) > 0 {
+		w.left = members[0].Size
+	}
+	return w, nil
+}
+
+// next moves on past any members which have been written in full.
+func (w *memberFiles) next() {
+	for w.left == 0 && w.current < len(w.members) {
+		w.current++
+		if w.current < len(w.members) {
+			w.left = w.members[w.current].Size
+		}
+	}
+}
+
+func (w *memberFiles) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		w.next()
+		if w.current == len(w.members) {
+			return written, fmt.Errorf("item has more data than its files add up to")
+		}
+		n := len(p)
+		if uint64(n) > w.left {
+			n = int(w.left)
+		}
+		n, err := w.files[w.current].Write(p[:n])
+		written += n
+		w.left -= uint64(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Commit moves all of the files into place.
+func (w *memberFiles) Commit() error {
+	w.next()
+	if w.current != len(w.members) {
+		return fmt.Errorf("item ended part way through %s", w.members[w.current].Name)
+	}
+	for i, f := range w.files {
+		if w.preserve {
+			err := f.setMetadata(w.members[i].Mode, w.members[i].ModTime)
+			if err != nil {
+				return err
+			}
+		}
+		err := f.Commit()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Abort removes any files which have not been committed.
+func (w *memberFiles) Abort() {
+	for _, f := range w.files {
+		f.Abort()
+	}
+}
+
+// paths returns where the files are written.
+func (w *memberFiles) paths() []string {
+	paths := make([]string, 0, len(w.files))
+	for _, f := range w.files {
+		paths = append(paths, f.path)
+	}
+	return paths
+}
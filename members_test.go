@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tardisx/netgiv/secure"
+)
+
+func TestMembers(t *testing.T) {
+	src := t.TempDir()
+	contents := map[string]string{"a.log": "first\n", "empty": "", "b.log": "second file\n"}
+	paths := []string{}
+	for _, name := range []string{"a.log", "empty", "b.log"} {
+		p := filepath.Join(src, name)
+		os.WriteFile(p, []byte(contents[name]), 0o644)
+		paths = append(paths, p)
+	}
+
+	r, err := openMembers(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "first\nsecond file\n" {
+		t.Errorf("read %q", data)
+	}
+	ngf := NGF{Members: cleanMembers(r.members), Size: uint64(len(data))}
+	err = ngf.addMemberDigests(r.digests())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range ngf.Members {
+		digest := sha256.Sum256([]byte(contents[m.Name]))
+		if !bytes.Equal(m.Digest, digest[:]) {
+			t.Errorf("wrong digest for %s", m.Name)
+		}
+	}
+	m, offset, ok := findMember(ngf.Members, "b.log")
+	if !ok || offset != 6 || m.Size != 12 {
+		t.Errorf("found b.log at %d, size %d", offset, m.Size)
+	}
+	section, _ := io.ReadAll(io.LimitReader(&skipReader{r: bytes.NewReader(data), skip: int64(offset)}, int64(m.Size)))
+	if string(section) != contents["b.log"] {
+		t.Errorf("picked out %q", section)
+	}
+
+	ngf.Size++
+	if ngf.addMemberDigests(r.digests()) == nil {
+		t.Error("no error when the members do not add up to the data")
+	}
+
+	if _, err := openMembers([]string{paths[0], paths[0]}); err == nil {
+		t.Error("no error sending two files with the same name")
+	}
+
+	dest := filepath.Join(t.TempDir(), "out")
+	w, err := newMemberFiles(dest, ngf.Members, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// written in odd sized pieces, across the members
+	w.Write(data[:4])
+	w.Write(data[4:9])
+	w.Write(data[9:])
+	err = w.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range contents {
+		got, err := os.ReadFile(filepath.Join(dest, name))
+		if err != nil || string(got) != content {
+			t.Errorf("%s contains %q, %v", name, got, err)
+		}
+	}
+
+	w, err = newMemberFiles(t.TempDir(), ngf.Members, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data[:9])
+	if w.Commit() == nil {
+		t.Error("no error committing files which have not all been written")
+	}
+	w.Abort()
+}
+
+func TestMembersLimits(t *testing.T) {
+	members := make([]secure.Member, maxMembers)
+	for i := range members {
+		members[i] = secure.Member{Name: fmt.Sprintf("%03d%s", i, strings.Repeat("n", maxNameLength-3)), Kind: strings.Repeat("k", maxMemberKindLength), Digest: make([]byte, sha256.Size)}
+	}
+	if err := validMembers(members); err != nil {
+		t.Errorf("the most members there can be are not valid: %v", err)
+	}
+	ngf := NGF{Members: members}
+	if err := ngf.describable(); err != nil {
+		t.Errorf("the most members there can be can't be described: %v", err)
+	}
+	if !secure.Fits(ngf.receiveData()) {
+		t.Error("the most members there can be can't be received")
+	}
+	if validMembers(append(members, secure.Member{Name: "one more"})) == nil {
+		t.Error("no error with too many members")
+	}
+	if validMembers([]secure.Member{{Name: "a", Kind: strings.Repeat("k", maxMemberKindLength+1)}}) == nil {
+		t.Error("no error with too long a kind")
+	}
+
+	// the metadata counts towards the description too
+	ngf.Meta = map[string]string{}
+	for i := 0; i < maxMetadataCount; i++ {
+		ngf.Meta[fmt.Sprintf("%03d%s", i, strings.Repeat("k", maxMetadataLength-3))] = strings.Repeat("v", maxMetadataLength)
+	}
+	if ngf.describable() == nil {
+		t.Error("no error when the description is too much to send")
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"unicode"
+
+	"github.com/tardisx/netgiv/secure"
+)
+
+// Items can be given labels, key/value metadata and a note when they are
+// copied, and --list can be filtered on them. A filter is a list of
+// key=pattern conditions, all of which an item has to match, where the
+// pattern is a shell pattern as in path.Match. These keys match the item
+// itself, and any other key matches the metadata with that key.
+var filterKeys = map[string]bool{
+	"label":    true, // any of the labels
+	"kind":     true,
+	"name":     true, // the name it was copied to
+	"filename": true,
+	"note":     true,
+}
+
+const (
+	// the longest a label, metadata key or value can be
+	maxMetadataLength = 255
+	// the longest a note can be
+	maxNoteLength = 1024
+	// the most labels or metadata keys an item can have
+	maxMetadataCount = 32
+)
+
+// validTerm returns an error if s can't be used as a label or metadata
+// key, which have to be usable in a filter.
+func validTerm(s string) error {
+	if s == "" {
+		return errors.New("is empty")
+	}
+	if len(s) > maxMetadataLength {
+		return errors.New("is too long")
+	}
+	for _, r := range s {
+		if unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return errors.New("can't contain spaces or control characters")
+		}
+		if r == ',' || r == '=' {
+			return errors.New("can't contain , or =")
+		}
+	}
+	return nil
+}
+
+// validMetadata returns an error if an item can't be given these labels,
+// metadata and note.
+func validMetadata(labels []string, meta map[string]string, note string) error {
+	if len(labels) > maxMetadataCount || len(meta) > maxMetadataCount {
+		return fmt.Errorf("can't have more than %d labels or metadata keys", maxMetadataCount)
+	}
+	for _, label := range labels {
+		if err := validTerm(label); err != nil {
+			return fmt.Errorf("label '%s' %v", label, err)
+		}
+	}
+	for key, value := range meta {
+		if err := validTerm(key); err != nil {
+			return fmt.Errorf("metadata key '%s' %v", key, err)
+		}
+		if filterKeys[key] {
+			return fmt.Errorf("metadata key '%s' is reserved for filtering on", key)
+		}
+		if len(value) > maxMetadataLength {
+			return fmt.Errorf("metadata value for '%s' is too long", key)
+		}
+	}
+	if len(note) > maxNoteLength {
+		return errors.New("note is too long")
+	}
+	return nil
+}
+
+// parseMeta parses metadata given as key=value.
+func parseMeta(s string) (string, string, error) {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return "", "", fmt.Errorf("metadata '%s' is not key=value", s)
+	}
+	return s[:i], s[i+1:], nil
+}
+
+// parseFilter parses the conditions of a --list filter, each key=pattern.
+func parseFilter(conditions []string) ([]secure.Filter, error) {
+	filter := []secure.Filter{}
+	for _, c := range conditions {
+		key, pattern, err := parseMeta(c)
+		if err != nil {
+			return nil, fmt.Errorf("filter '%s' is not key=pattern", c)
+		}
+		if key == "" {
+			return nil, fmt.Errorf("filter '%s' has no key", c)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("filter '%s' has a bad pattern: %v", c, err)
+		}
+		filter = append(filter, secure.Filter{Key: key, Pattern: pattern})
+	}
+	return filter, nil
+}
+
+// matches returns true if the NGF matches every condition of a filter.
+func (ngf NGF) matches(filter []secure.Filter) bool {
+	for _, f := range filter {
+		if !ngf.matchesCondition(f) {
+			return false
+		}
+	}
+	return true
+}
+
+func (ngf NGF) matchesCondition(f secure.Filter) bool {
+	match := func(s string) bool {
+		ok, err := path.Match(f.Pattern, s)
+		return err == nil && ok
+	}
+	switch f.Key {
+	case "label":
+		for _, label := range ngf.Labels {
+			if match(label) {
+				return true
+			}
+		}
+		return false
+	case "kind":
+		// so kind=text/* finds text
+		return match(ngf.Kind) || match(kindMIME(ngf.Kind))
+	case "name":
+		return match(ngf.Name)
+	case "filename":
+		return match(ngf.Filename)
+	case "note":
+		return match(ngf.Note)
+	}
+	value, ok := ngf.Meta[f.Key]
+	return ok && match(value)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidMetadata(t *testing.T) {
+	err := validMetadata([]string{"db", "prod"}, map[string]string{"host": "web1", "desc": "a, b = c"}, "before migration")
+	if err != nil {
+		t.Errorf("valid metadata rejected: %v", err)
+	}
+	bad := []struct {
+		labels []string
+		meta   map[string]string
+		note   string
+	}{
+		{labels: []string{""}},
+		{labels: []string{"a b"}},
+		{labels: []string{"a,b"}},
+		{meta: map[string]string{"a=b": "c"}},
+		{meta: map[string]string{"kind": "x"}},
+		{meta: map[string]string{"host": strings.Repeat("a", maxMetadataLength+1)}},
+		{note: strings.Repeat("a", maxNoteLength+1)},
+	}
+	for _, tc := range bad {
+		if validMetadata(tc.labels, tc.meta, tc.note) == nil {
+			t.Errorf("%v accepted", tc)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	ngf := NGF{
+		Name:     "dump",
+		Filename: "dump.sql",
+		Kind:     "UTF-8 text",
+		Labels:   []string{"db", "prod"},
+		Meta:     map[string]string{"host": "web1"},
+		Note:     "before migration",
+	}
+	tests := []struct {
+		filter  []string
+		matches bool
+	}{
+		{nil, true},
+		{[]string{"label=db"}, true},
+		{[]string{"label=prod", "label=db"}, true},
+		{[]string{"label=staging"}, false},
+		{[]string{"label=db", "kind=text/*"}, true},
+		{[]string{"kind=UTF-8*"}, true},
+		{[]string{"kind=image/*"}, false},
+		{[]string{"name=dump"}, true},
+		{[]string{"filename=*.sql"}, true},
+		{[]string{"note=*migration*"}, true},
+		{[]string{"host=web?"}, true},
+		{[]string{"host=web2"}, false},
+		{[]string{"rack=*"}, false},
+	}
+	for _, tc := range tests {
+		filter, err := parseFilter(tc.filter)
+		if err != nil {
+			t.Errorf("%v: %v", tc.filter, err)
+			continue
+		}
+		if ngf.matches(filter) != tc.matches {
+			t.Errorf("%v matches is %v", tc.filter, !tc.matches)
+		}
+	}
+
+	for _, bad := range []string{"label", "=db", "label=["} {
+		if _, err := parseFilter([]string{bad}); err == nil {
+			t.Errorf("filter %q accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// maxNameLength is the longest name an item can be copied to.
+const maxNameLength = 255
+
+// validName returns an error if an item cannot be copied to name. Names
+// can't be confused with ids or selectors, so they can be given in their
+// place.
+func validName(name string) error {
+	if name == "" {
+		return errors.New("name is empty")
+	}
+	if len(name) > maxNameLength {
+		return errors.New("name is too long")
+	}
+	if _, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return errors.New("name can't be a number, that would be an id")
+	}
+	if isSelector(name) {
+		return errors.New("name can't contain : or start with ~, or be all, that would be a selector")
+	}
+	for _, r := range name {
+		if unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return errors.New("name can't contain spaces or control characters")
+		}
+		if r == '@' {
+			return errors.New("name can't contain @, that is used for versions")
+		}
+		if r == ',' {
+			return errors.New("name can't contain , that is used for lists")
+		}
+	}
+	return nil
+}
+
+// parseVersion splits a name like "staging.env@3" into the name and the
+// version of it, or 0 if no version is given.
+func parseVersion(s string) (string, uint32, error) {
+	version := uint64(0)
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		var err error
+		version, err = strconv.ParseUint(s[i+1:], 10, 32)
+		if err != nil || version == 0 {
+			return "", 0, fmt.Errorf("bad version '%s'", s[i+1:])
+		}
+		s = s[:i]
+	}
+	err := validName(s)
+	if err != nil {
+		return "", 0, err
+	}
+	return s, uint32(version), nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidName(t *testing.T) {
+	for _, name := range []string{"staging.env", "db-backup", "x1", "99999999999"} {
+		if err := validName(name); err != nil {
+			t.Errorf("%q rejected: %v", name, err)
+		}
+	}
+	for _, name := range []string{"", "12", "0", "a b", "tab\there", "nl\n", "a@b", "kind:x", "~1", "all", "a,b", "3,4", strings.Repeat("a", maxNameLength+1)} {
+		if validName(name) == nil {
+			t.Errorf("%q accepted", name)
+		}
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		in      string
+		name    string
+		version uint32
+	}{
+		{"staging.env", "staging.env", 0},
+		{"staging.env@3", "staging.env", 3},
+		{"x@12", "x", 12},
+	}
+	for _, tc := range tests {
+		name, version, err := parseVersion(tc.in)
+		if err != nil || name != tc.name || version != tc.version {
+			t.Errorf("parseVersion(%q) = %q, %d, %v", tc.in, name, version, err)
+		}
+	}
+	for _, in := range []string{"x@", "x@0", "x@-1", "x@y", "@3", "12@3", "a@b@3"} {
+		if _, _, err := parseVersion(in); err == nil {
+			t.Errorf("parseVersion(%q) accepted", in)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// cleanFilename returns just the last element of a filename sent to us,
+// or "" if there is nothing usable, so it cannot refer to anywhere other
+// than the directory it is written to.
+func cleanFilename(name string) string {
+	name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+	if name == "." || name == ".." || name == "/" {
+		return ""
+	}
+	return name
+}
+
+// outputPath works out where to write an item for -o. If output is a
+// directory, or ends with a separator to say it should be one, it is
+// written there under the name it was sent with, otherwise output is the
+// name to write it to.
+func outputPath(output string, filename string) (string, error) {
+	info, err := os.Stat(output)
+	isDir := err == nil && info.IsDir()
+	if !isDir && !strings.HasSuffix(output, string(filepath.Separator)) && !strings.HasSuffix(output, "/") {
+		return output, nil
+	}
+	name := cleanFilename(filename)
+	if name == "" {
+		return "", errors.New("item was not sent with a filename, give -o a filename to write it to")
+	}
+	if !isDir {
+		err := os.MkdirAll(output, 0o777)
+		if err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(output, name), nil
+}
+
+// atomicFile is written under a temporary name in the same directory as
+// the file, and only appears under the real name once it is complete, so
+// a failed paste never leaves a partial file behind.
+type atomicFile struct {
+	*os.File
+	path      string
+	force     bool // replace the file if it exists
+	committed bool
+}
+
+// createAtomic starts writing the file at path. Unless force is set, it
+// is an error for the file to exist already.
+func createAtomic(path string, force bool) (*atomicFile, error) {
+	if !force {
+		if _, err := os.Lstat(path); err == nil {
+			return nil, fmt.Errorf("%s already exists, use --force to overwrite it", path)
+		}
+	}
+	var f *os.File
+	dir, base := filepath.Split(path)
+	_, err := createTemp(dir, base, func(tmp string) error {
+		// created like any other new file, so the umask applies
+		var err error
+		f, err = os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o666)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &atomicFile{File: f, path: path, force: force}, nil
+}
+
+// createTemp creates something with a temporary name in dir, based on
+// name, by calling create with it until it does not already exist. It
+// returns the name used.
+func createTemp(dir string, name string, create func(string) error) (string, error) {
+	for {
+		suffix := make([]byte, 4)
+		_, err := rand.Read(suffix)
+		if err != nil {
+			return "", err
+		}
+		tmp := filepath.Join(dir, "."+name+".netgiv-"+hex.EncodeToString(suffix))
+		err = create(tmp)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return tmp, nil
+	}
+}
+
+// setMetadata sets the permissions and modification time of the file,
+// where they are known.
+func (f *atomicFile) setMetadata(mode uint32, modTime time.Time) error {
+	if mode != 0 {
+		err := f.Chmod(os.FileMode(mode) & os.ModePerm)
+		if err != nil {
+			return err
+		}
+	}
+	if !modTime.IsZero() {
+		// times are set on the name, so make sure nothing is still to be
+		// written, which would change it
+		err := f.Sync()
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(f.Name(), modTime, modTime)
+	}
+	return nil
+}
+
+// Commit moves the completed file into place.
+func (f *atomicFile) Commit() error {
+	err := f.File.Close()
+	if err != nil {
+		return err
+	}
+	if f.force {
+		err = os.Rename(f.Name(), f.path)
+	} else {
+		// a link fails if something appeared under the name while we
+		// were writing, where a rename would replace it
+		err = os.Link(f.Name(), f.path)
+		switch {
+		case err == nil:
+			err = os.Remove(f.Name())
+		case errors.Is(err, os.ErrExist):
+			err = fmt.Errorf("%s already exists, use --force to overwrite it", f.path)
+		default:
+			// not every filesystem has hard links, so settle for checking
+			// first
+			if _, statErr := os.Lstat(f.path); statErr == nil {
+				err = fmt.Errorf("%s already exists, use --force to overwrite it", f.path)
+			} else {
+				err = os.Rename(f.Name(), f.path)
+			}
+		}
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	f.committed = true
+	return nil
+}
+
+// Abort removes the file, unless it has been committed.
+func (f *atomicFile) Abort() {
+	if f.committed {
+		return
+	}
+	_ = f.File.Close()
+	_ = os.Remove(f.Name())
+}
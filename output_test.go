@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCleanFilename(t *testing.T) {
+	for name, want := range map[string]string{
+		"report.pdf":         "report.pdf",
+		"../../etc/passwd":   "passwd",
+		"/etc/passwd":        "passwd",
+		`..\..\windows\evil`: "evil",
+		"..":                 "",
+		"/":                  "",
+		"":                   "",
+	} {
+		if got := cleanFilename(name); got != want {
+			t.Errorf("cleanFilename(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestAtomicFile(t *testing.T) {
+	dir := t.TempDir()
+
+	path, err := outputPath(dir, "../report.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != filepath.Join(dir, "report.txt") {
+		t.Fatalf("wrong output path %s", path)
+	}
+	if _, err := outputPath(dir, ""); err == nil {
+		t.Error("no error writing an item without a filename to a directory")
+	}
+
+	f, err := createAtomic(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("first"))
+	if _, err := os.Stat(path); err == nil {
+		t.Error("file exists before it is committed")
+	}
+	if err := f.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := createAtomic(path, false); err == nil {
+		t.Error("no error creating a file which exists")
+	}
+
+	// an aborted file leaves the existing one alone
+	f, err = createAtomic(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("second"))
+	f.Abort()
+	if data, _ := os.ReadFile(path); string(data) != "first" {
+		t.Errorf("file contains %q after an aborted overwrite", data)
+	}
+
+	f, err = createAtomic(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("third"))
+	if err := f.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "third" {
+		t.Errorf("file contains %q after a forced overwrite", data)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("%d files left in the directory, expected 1", len(entries))
+	}
+}
+
+func TestAtomicFileMetadata(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "script.sh")
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	f, err := createAtomic(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("#!/bin/sh\n"))
+	if err := f.setMetadata(0o750, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o750 {
+		t.Errorf("mode is %v, expected 0750", info.Mode().Perm())
+	}
+	if !info.ModTime().Equal(modTime) {
+		t.Errorf("modification time is %v, expected %v", info.ModTime(), modTime)
+	}
+}
@@ -0,0 +1,104 @@
+package secure
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Messages on a SecureConnection can be compressed before they are
+// encrypted, with a method agreed in the start packets. Compression is
+// decided message by message, for instance to skip data which is already
+// compressed, and compressed messages are marked as such. The method can
+// be told from the compressed data itself.
+const (
+	CompressionZstd = "zstd"
+	CompressionGzip = "gzip"
+
+	zstdMagic = "\x28\xb5\x2f\xfd"
+	gzipMagic = "\x1f\x8b"
+
+	// the largest a message can decompress to
+	maxDecompressedSize = 1 << 20
+)
+
+// SupportedCompression lists the compression methods we can use, most
+// preferred first.
+var SupportedCompression = []string{CompressionZstd, CompressionGzip}
+
+// NegotiateCompression returns the first of the offered compression
+// methods we support, or "" if there are none.
+func NegotiateCompression(offered []string) string {
+	for _, method := range offered {
+		for _, supported := range SupportedCompression {
+			if method == supported {
+				return method
+			}
+		}
+	}
+	return ""
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+func zstdCodecs() (*zstd.Encoder, *zstd.Decoder) {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxDecompressedSize))
+	})
+	return zstdEncoder, zstdDecoder
+}
+
+// compressMessage compresses a message, returning nil if it does not get
+// any smaller.
+func compressMessage(method string, p []byte) []byte {
+	var compressed []byte
+	switch method {
+	case CompressionZstd:
+		enc, _ := zstdCodecs()
+		compressed = enc.EncodeAll(p, nil)
+	case CompressionGzip:
+		buf := &bytes.Buffer{}
+		w, _ := gzip.NewWriterLevel(buf, gzip.BestSpeed)
+		_, _ = w.Write(p)
+		_ = w.Close()
+		compressed = buf.Bytes()
+	default:
+		return nil
+	}
+	if len(compressed) >= len(p) {
+		return nil
+	}
+	return compressed
+}
+
+func decompressMessage(p []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(p, []byte(zstdMagic)):
+		_, dec := zstdCodecs()
+		return dec.DecodeAll(p, nil)
+	case bytes.HasPrefix(p, []byte(gzipMagic)):
+		r, err := gzip.NewReader(bytes.NewReader(p))
+		if err != nil {
+			return nil, err
+		}
+		out, err := io.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(out) > maxDecompressedSize {
+			return nil, errors.New("message is too large")
+		}
+		return out, nil
+	default:
+		return nil, errors.New("unknown compression method")
+	}
+}
@@ -0,0 +1,120 @@
+package secure
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// WrappedKeySize is the size of a data key once wrapped by a Keyring.
+const WrappedKeySize = 24 + 32 + secretbox.Overhead
+
+// A Keyring holds named master keys, which are used to wrap (encrypt) the
+// data keys for individual items. New data keys are always wrapped with
+// the current key, but any key in the ring can unwrap, so the master key
+// can be rotated by adding a new current key and keeping the old ones
+// until nothing wrapped with them remains.
+type Keyring struct {
+	keys    map[string]*[32]byte
+	current string
+}
+
+// NewKeyring returns a Keyring with a single key.
+func NewKeyring(id string, key *[32]byte) *Keyring {
+	return &Keyring{keys: map[string]*[32]byte{id: key}, current: id}
+}
+
+// ParseKeyring reads a keyring, which consists of lines of a key id and a
+// base64 encoded 32 byte key, separated by whitespace. The first key is
+// the current one. Blank lines and lines starting with # are ignored.
+func ParseKeyring(r io.Reader) (*Keyring, error) {
+	k := &Keyring{keys: map[string]*[32]byte{}}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("bad keyring line '%s', expected id and key", line)
+		}
+		if len(fields[0]) > 255 {
+			return nil, fmt.Errorf("key id '%s' is too long", fields[0])
+		}
+		key, err := ParseKey(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("bad key for '%s': %v", fields[0], err)
+		}
+		if _, exists := k.keys[fields[0]]; exists {
+			return nil, fmt.Errorf("duplicate key id '%s'", fields[0])
+		}
+		k.keys[fields[0]] = key
+		if k.current == "" {
+			k.current = fields[0]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if k.current == "" {
+		return nil, errors.New("no keys in keyring")
+	}
+	return k, nil
+}
+
+// ParseKey decodes a base64 encoded 32 byte key.
+func ParseKey(s string) (*[32]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 32 {
+		return nil, fmt.Errorf("key is %d bytes, must be 32", len(b))
+	}
+	key := [32]byte{}
+	copy(key[:], b)
+	return &key, nil
+}
+
+// NewDataKey returns a new random key.
+func NewDataKey() *[32]byte {
+	key := [32]byte{}
+	_, _ = rand.Read(key[:])
+	return &key
+}
+
+// Wrap encrypts a data key with the current master key, returning the id
+// of the master key and the wrapped key.
+func (k *Keyring) Wrap(dataKey *[32]byte) (string, []byte) {
+	var nonce [24]byte
+	_, _ = rand.Read(nonce[:])
+	wrapped := secretbox.Seal(nonce[:], dataKey[:], &nonce, k.keys[k.current])
+	return k.current, wrapped
+}
+
+// Unwrap decrypts a data key wrapped with the named master key.
+func (k *Keyring) Unwrap(id string, wrapped []byte) (*[32]byte, error) {
+	masterKey, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("master key '%s' is not in the keyring", id)
+	}
+	if len(wrapped) != WrappedKeySize {
+		return nil, errors.New("wrapped key is the wrong size")
+	}
+	var nonce [24]byte
+	copy(nonce[:], wrapped)
+	dataKey, ok := secretbox.Open(nil, wrapped[24:], &nonce, masterKey)
+	if !ok {
+		return nil, fmt.Errorf("could not unwrap data key with master key '%s'", id)
+	}
+	key := [32]byte{}
+	copy(key[:], dataKey)
+	return &key, nil
+}
@@ -0,0 +1,44 @@
+package secure
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+func TestKeyring(t *testing.T) {
+	old := NewKeyring("old", NewDataKey())
+	dataKey := NewDataKey()
+	id, wrapped := old.Wrap(dataKey)
+	if id != "old" {
+		t.Errorf("wrapped with %s, expected old", id)
+	}
+
+	// rotate, keeping the old key
+	oldKey := old.keys["old"]
+	ring, err := ParseKeyring(bytes.NewBufferString("# rotated\nnew " + base64Key(NewDataKey()) + "\n\nold " + base64Key(oldKey) + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newId, _ := ring.Wrap(dataKey); newId != "new" {
+		t.Errorf("wrapped with %s, expected new", newId)
+	}
+	unwrapped, err := ring.Unwrap(id, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *unwrapped != *dataKey {
+		t.Error("unwrapped key does not match")
+	}
+
+	if _, err := NewKeyring("other", NewDataKey()).Unwrap(id, wrapped); err == nil {
+		t.Error("unwrapped with a missing key")
+	}
+	if _, err := ParseKeyring(bytes.NewBufferString("a short\n")); err == nil {
+		t.Error("parsed a bad key")
+	}
+}
+
+func base64Key(key *[32]byte) string {
+	return base64.StdEncoding.EncodeToString(key[:])
+}
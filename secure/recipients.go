@@ -0,0 +1,147 @@
+package secure
+
+import (
+	"bufio"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// A recipient stream is a stream (see NewStreamWriter) encrypted with a
+// random key, which is stored at the start sealed to the X25519 public
+// key of each recipient, so only the holders of the matching private keys
+// can decrypt it.
+const (
+	recipientsMagic = "NGR1"
+	// each recipient's copy of the key is sealed with an ephemeral key,
+	// which is stored in front of it
+	recipientStanzaSize = 32 + 32 + box.Overhead
+	MaxRecipients       = 255
+)
+
+// ErrNotRecipient is returned when a recipient stream was not encrypted
+// to the identity trying to read it.
+var ErrNotRecipient = errors.New("not a recipient")
+
+// A NamedKey is the public key of someone, like a recipient to encrypt
+// data to, or a trusted signer.
+type NamedKey struct {
+	Name      string
+	PublicKey *[32]byte
+}
+
+// ParseNamedKeys reads a list of named keys, which consists of lines of a
+// name and a base64 encoded public key, separated by whitespace. Blank
+// lines and lines starting with # are ignored.
+func ParseNamedKeys(r io.Reader) ([]NamedKey, error) {
+	keys := []NamedKey{}
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("bad line '%s', expected name and public key", line)
+		}
+		key, err := ParseKey(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("bad public key for '%s': %v", fields[0], err)
+		}
+		if seen[fields[0]] {
+			return nil, fmt.Errorf("duplicate name '%s'", fields[0])
+		}
+		seen[fields[0]] = true
+		keys = append(keys, NamedKey{Name: fields[0], PublicKey: key})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// GenerateIdentity returns a new X25519 key pair.
+func GenerateIdentity() (publicKey, privateKey *[32]byte) {
+	publicKey, privateKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return publicKey, privateKey
+}
+
+// IdentityPublicKey returns the public key for an X25519 private key.
+func IdentityPublicKey(privateKey *[32]byte) *[32]byte {
+	pub, err := curve25519.X25519(privateKey[:], curve25519.Basepoint)
+	if err != nil {
+		panic(err)
+	}
+	key := [32]byte{}
+	copy(key[:], pub)
+	return &key
+}
+
+// NewRecipientWriter returns a StreamWriter which encrypts data to w, so it
+// can be decrypted by any of the given public keys.
+func NewRecipientWriter(w io.Writer, publicKeys []*[32]byte) (*StreamWriter, error) {
+	if len(publicKeys) == 0 {
+		return nil, errors.New("no recipients")
+	}
+	if len(publicKeys) > MaxRecipients {
+		return nil, fmt.Errorf("too many recipients, the most is %d", MaxRecipients)
+	}
+	key := NewDataKey()
+	header := []byte(recipientsMagic)
+	header = append(header, byte(len(publicKeys)))
+	for _, pub := range publicKeys {
+		var err error
+		header, err = box.SealAnonymous(header, key[:], pub, rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err := w.Write(header)
+	if err != nil {
+		return nil, err
+	}
+	return NewStreamWriter(w, key)
+}
+
+// NewRecipientReader returns a StreamReader which decrypts data written by
+// a writer from NewRecipientWriter, with the private key of one of the
+// recipients. If the data was not encrypted to that key, it returns
+// ErrNotRecipient.
+func NewRecipientReader(r io.Reader, privateKey *[32]byte) (*StreamReader, error) {
+	start := make([]byte, len(recipientsMagic)+1)
+	_, err := io.ReadFull(r, start)
+	if err != nil {
+		return nil, err
+	}
+	if string(start[:len(recipientsMagic)]) != recipientsMagic {
+		return nil, errors.New("not a recipient stream")
+	}
+	stanzas := make([]byte, int(start[len(recipientsMagic)])*recipientStanzaSize)
+	_, err = io.ReadFull(r, stanzas)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey := IdentityPublicKey(privateKey)
+	for len(stanzas) > 0 {
+		opened, ok := box.OpenAnonymous(nil, stanzas[:recipientStanzaSize], publicKey, privateKey)
+		stanzas = stanzas[recipientStanzaSize:]
+		if !ok {
+			continue
+		}
+		key := [32]byte{}
+		copy(key[:], opened)
+		return NewStreamReader(r, &key)
+	}
+	return nil, ErrNotRecipient
+}
@@ -0,0 +1,62 @@
+package secure
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRecipientStream(t *testing.T) {
+	alicePub, alicePriv := GenerateIdentity()
+	bobPub, bobPriv := GenerateIdentity()
+	_, evePriv := GenerateIdentity()
+
+	out := &bytes.Buffer{}
+	w, err := NewRecipientWriter(out, []*[32]byte{alicePub, bobPub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = w.Write([]byte("hello"))
+	_ = w.Close()
+	encrypted := out.Bytes()
+
+	for name, priv := range map[string]*[32]byte{"alice": alicePriv, "bob": bobPriv} {
+		r, err := NewRecipientReader(bytes.NewReader(encrypted), priv)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		decrypted, err := io.ReadAll(r)
+		if err != nil || string(decrypted) != "hello" {
+			t.Errorf("%s: expected hello, got %q (%v)", name, decrypted, err)
+		}
+	}
+
+	if _, err := NewRecipientReader(bytes.NewReader(encrypted), evePriv); err != ErrNotRecipient {
+		t.Errorf("expected ErrNotRecipient for eve, got %v", err)
+	}
+}
+
+func TestParseNamedKeys(t *testing.T) {
+	pub, priv := GenerateIdentity()
+	if *IdentityPublicKey(priv) != *pub {
+		t.Error("public key does not match the one generated")
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(pub[:])
+	keys, err := ParseNamedKeys(strings.NewReader("# team\nalice " + encoded + "\n\nbob  " + encoded + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].Name != "alice" || keys[1].Name != "bob" || *keys[1].PublicKey != *pub {
+		t.Errorf("unexpected keys %v", keys)
+	}
+
+	if _, err := ParseNamedKeys(strings.NewReader("alice " + encoded + "\nalice " + encoded)); err == nil {
+		t.Error("expected an error for a duplicate name")
+	}
+	if _, err := ParseNamedKeys(strings.NewReader("alice notbase64!")); err == nil {
+		t.Error("expected an error for a bad key")
+	}
+}
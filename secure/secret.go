@@ -0,0 +1,61 @@
+package secure
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// A secret stream is a stream (see NewStreamWriter) encrypted with a key
+// derived from a secret, like a passphrase, with scrypt. The salt is
+// stored at the start.
+const (
+	secretMagic    = "NGP1"
+	secretSaltSize = 16
+)
+
+func secretKey(secret []byte, salt []byte) (*[32]byte, error) {
+	derived, err := scrypt.Key(secret, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	key := [32]byte{}
+	copy(key[:], derived)
+	return &key, nil
+}
+
+// NewSecretWriter returns a StreamWriter which encrypts data to w with a
+// key derived from secret.
+func NewSecretWriter(w io.Writer, secret []byte) (*StreamWriter, error) {
+	salt := make([]byte, secretSaltSize)
+	_, _ = rand.Read(salt)
+	key, err := secretKey(secret, salt)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(append([]byte(secretMagic), salt...))
+	if err != nil {
+		return nil, err
+	}
+	return NewStreamWriter(w, key)
+}
+
+// NewSecretReader returns a StreamReader which decrypts data written by a
+// writer from NewSecretWriter.
+func NewSecretReader(r io.Reader, secret []byte) (*StreamReader, error) {
+	header := make([]byte, len(secretMagic)+secretSaltSize)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	if string(header[:len(secretMagic)]) != secretMagic {
+		return nil, errors.New("not a secret stream")
+	}
+	key, err := secretKey(secret, header[len(secretMagic):])
+	if err != nil {
+		return nil, err
+	}
+	return NewStreamReader(r, key)
+}
@@ -0,0 +1,35 @@
+package secure
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestSecretStream(t *testing.T) {
+	out := &bytes.Buffer{}
+	w, err := NewSecretWriter(out, []byte("team secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = w.Write([]byte("hello"))
+	_ = w.Close()
+	encrypted := out.Bytes()
+
+	r, err := NewSecretReader(bytes.NewReader(encrypted), []byte("team secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := io.ReadAll(r)
+	if err != nil || string(decrypted) != "hello" {
+		t.Errorf("expected hello, got %q (%v)", decrypted, err)
+	}
+
+	r, err = NewSecretReader(bytes.NewReader(encrypted), []byte("wrong secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err != ErrStreamDecrypt {
+		t.Errorf("expected ErrStreamDecrypt with the wrong secret, got %v", err)
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/binary"
+	"encoding/gob"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"time"
@@ -15,14 +17,34 @@ import (
 )
 
 type SecureMessage struct {
-	Msg   []byte
-	Size  uint16
-	Nonce [24]byte
+	Msg        []byte
+	Size       uint16
+	Nonce      [24]byte
+	Compressed bool // the decrypted message needs decompressing
+}
+
+// The top bit of the size marks a compressed message, which limits the
+// size of a message to the rest.
+const (
+	sizeCompressed = 0x8000
+	MaxMessageSize = sizeCompressed - 1
+)
+
+// Fits reports whether a packet is small enough to be sent as one message,
+// before any compression.
+func Fits(packet interface{}) bool {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(packet)
+	return err == nil && buf.Len()+box.Overhead <= MaxMessageSize
 }
 
 func (s *SecureMessage) toByteArray() []byte {
 	length := []byte{0x0, 0x0}
-	binary.BigEndian.PutUint16(length, uint16(len(s.Msg)))
+	size := uint16(len(s.Msg))
+	if s.Compressed {
+		size |= sizeCompressed
+	}
+	binary.BigEndian.PutUint16(length, size)
 	out := append(s.Nonce[:], length...)
 	out = append(out, s.Msg[:]...)
 	return out
@@ -33,7 +55,7 @@ func DeterminePacketSize(data []byte) uint16 {
 	if len(data) < 26 {
 		return 0
 	}
-	size := binary.BigEndian.Uint16(data[24:26])
+	size := binary.BigEndian.Uint16(data[24:26]) &^ sizeCompressed
 	size += 26 // add the length header and the nonce
 	return size
 }
@@ -42,12 +64,14 @@ func ConstructSecureMessage(sm []byte) SecureMessage {
 	var nonce [24]byte
 	nonceArray := sm[:24]
 	size := binary.BigEndian.Uint16(sm[24:26])
+	compressed := size&sizeCompressed != 0
+	size &^= sizeCompressed
 	copy(nonce[:], nonceArray)
 
 	// Trim out all unnecessary bytes
 	// msg := bytes.Trim(sm[24:], "\x00")
 
-	return SecureMessage{Msg: sm[26 : 26+size], Size: size, Nonce: nonce}
+	return SecureMessage{Msg: sm[26 : 26+size], Size: size, Nonce: nonce, Compressed: compressed}
 }
 
 type SecureConnection struct {
@@ -55,23 +79,60 @@ type SecureConnection struct {
 	Conn      io.ReadWriteCloser
 	SharedKey *[32]byte
 	Buffer    *bytes.Buffer
+
+	plain []byte // decrypted data not yet read
+	eof   bool
+
+	compression  string // method agreed with the other side for writing, if any
+	skipCompress bool   // don't compress the messages we write
+}
+
+// SetCompression starts compressing the messages we write with the given
+// method, as agreed in the start packets. Compressed messages are marked
+// as such, so can always be read whatever has been agreed.
+func (s *SecureConnection) SetCompression(method string) {
+	s.compression = method
+}
+
+// SkipCompression stops (or restarts) compression of the messages we
+// write, for data which will not compress. Messages we read are
+// unaffected.
+func (s *SecureConnection) SkipCompression(skip bool) {
+	s.skipCompress = skip
+}
+
+func (s *SecureConnection) Close() error {
+	return s.Conn.Close()
 }
 
 func (s *SecureConnection) Read(p []byte) (int, error) {
-	message := make([]byte, 2048)
-	// Read the message from the buffer
-	eof := false
+	for len(s.plain) == 0 {
+		if s.eof {
+			return 0, io.EOF
+		}
+		err := s.readMessages()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
 
-	outputBytes := make([]byte, 0)
+// readMessages reads from the connection, and decrypts any complete
+// messages that have arrived.
+func (s *SecureConnection) readMessages() error {
+	message := make([]byte, 32*1024)
 
 	n, err := s.Conn.Read(message)
 
 	if err != nil && err != io.EOF {
 		log.Errorf("read: error in connection read %v", err)
-		return 0, err
+		return err
 	}
 	if err == io.EOF {
-		eof = true
+		s.eof = true
 	}
 	s.Buffer.Write(message[:n])
 
@@ -91,11 +152,11 @@ func (s *SecureConnection) Read(p []byte) (int, error) {
 		n, err := s.Buffer.Read(encryptedBytes)
 		if err != nil && err != io.EOF {
 			log.Errorf("failed to get encrypted bytes from buffer?")
-			return 0, errors.New("failed to get encrypted bytes from buffer")
+			return errors.New("failed to get encrypted bytes from buffer")
 		}
 		if n != int(actualPacketEnd) {
 			log.Errorf("failed to get right number of encrypted bytes from buffer")
-			return 0, errors.New("failed to get right number of encrypted bytes from buffer")
+			return errors.New("failed to get right number of encrypted bytes from buffer")
 
 		}
 		secureMessage := ConstructSecureMessage(encryptedBytes)
@@ -103,41 +164,51 @@ func (s *SecureConnection) Read(p []byte) (int, error) {
 		decryptedMessage, ok := box.OpenAfterPrecomputation(nil, secureMessage.Msg, &secureMessage.Nonce, s.SharedKey)
 
 		if !ok {
-			return 0, errors.New("problem decrypting the message")
+			return errors.New("problem decrypting the message")
 		}
 
-		outputBytes = append(outputBytes, decryptedMessage...)
-
-		if eof && s.Buffer.Len() == 0 {
-			log.Debugf("returning the final packet")
-			break
+		if secureMessage.Compressed {
+			decryptedMessage, err = decompressMessage(decryptedMessage)
+			if err != nil {
+				return fmt.Errorf("problem decompressing the message: %v", err)
+			}
 		}
 
+		s.plain = append(s.plain, decryptedMessage...)
 	}
 
-	err = io.EOF
-	if !eof {
-		err = nil
-	}
-
-	copy(p, outputBytes)
-
-	return len(outputBytes), err
+	return nil
 }
 
 func (s *SecureConnection) Write(p []byte) (int, error) {
 	var nonce [24]byte
 
+	message := p
+	compressed := false
+	if s.compression != "" && !s.skipCompress {
+		if c := compressMessage(s.compression, p); c != nil {
+			message = c
+			compressed = true
+		}
+	}
+
 	// Create a new nonce for each message sent
 	_, _ = rand.Read(nonce[:])
 
-	encryptedMessage := box.SealAfterPrecomputation(nil, p, &nonce, s.SharedKey)
-	sm := SecureMessage{Msg: encryptedMessage, Nonce: nonce}
+	encryptedMessage := box.SealAfterPrecomputation(nil, message, &nonce, s.SharedKey)
+	if len(encryptedMessage) > MaxMessageSize {
+		return 0, errors.New("message is too large")
+	}
+	sm := SecureMessage{Msg: encryptedMessage, Nonce: nonce, Compressed: compressed}
 
 	// Write it to the connection
 	wireBytes := sm.toByteArray()
 
-	return s.Conn.Write(wireBytes)
+	_, err := s.Conn.Write(wireBytes)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
 }
 
 func Handshake(conn *net.TCPConn) *[32]byte {
@@ -163,6 +234,12 @@ const (
 	OperationTypeList
 	OperationTypeReceive
 	OperationTypeBurn
+	OperationTypeTrashList
+	OperationTypeRestore
+	OperationTypeSendDigest
+	OperationTypeInfo
+	OperationTypeHistory
+	OperationTypeRollback
 )
 
 // PacketStartRequest is sent from the client to the server at the beginning
@@ -172,6 +249,8 @@ type PacketStartRequest struct {
 	ClientName      string
 	ProtocolVersion string
 	AuthToken       string
+	// compression methods the client can use, most preferred first
+	Compression []string
 }
 
 type PacketStartResponseEnum byte
@@ -187,21 +266,148 @@ const (
 
 type PacketStartResponse struct {
 	Response PacketStartResponseEnum
+	// the compression method chosen from those offered, if any. Messages
+	// after this one are compressed with it (see SetCompression)
+	Compression string
 }
 
+// EncryptionEnum records how an item was encrypted by the client before
+// being sent, on top of the encryption of the connection itself. The
+// values are flags, as more than one may apply.
+type EncryptionEnum byte
+
+const (
+	// Encrypted with a key derived from a secret shared by the team
+	EncryptionTeam EncryptionEnum = 1 << iota
+	// Encrypted with a key derived from a passphrase for this item only
+	EncryptionPassphrase
+	// Encrypted to the public keys of particular recipients
+	EncryptionRecipients
+)
+
 type PacketSendDataStart struct {
+	// the name to copy the item to, replacing the item with that name, if
+	// there is one
+	Name      string
 	Filename  string
-	TotalSize uint32
+	TotalSize uint64
+	// Kind is set by the client when the data is encrypted, as the
+	// server cannot determine it
+	Kind       string
+	Encryption EncryptionEnum
+	// names of the recipients, with EncryptionRecipients
+	Recipients []string
+	// Unix permission bits and modification time of the file sent, if
+	// the data came from a named file, otherwise zero
+	Mode    uint32
+	ModTime time.Time
+	// the data is a bundle of a directory, a tar with every entry under
+	// Filename, which may be compressed
+	Directory bool
+	// the files the data is made of, if more than one was sent, without
+	// their digests, which follow in the PacketSendDataEnd
+	Members []Member
+	// labels, key/value metadata and a note to describe the item
+	Labels []string
+	Meta   map[string]string
+	Note   string
+}
+
+// A Member is one of the files in an item sent from several at once. The
+// data of the members is stored one after the other, in order.
+type Member struct {
+	Name    string
+	Size    uint64
+	Kind    string
+	Mode    uint32
+	ModTime time.Time
+	Digest  []byte // SHA-256 of the member's data
 }
 type PacketSendDataNext struct {
 	Size uint16
 	Data []byte
+	Last bool // no more data, a PacketSendDataEnd follows
+}
+
+// PacketSendDataEnd is sent by the client after the last data packet,
+// to finish the upload. An upload which does not end with one is discarded.
+type PacketSendDataEnd struct {
+	// SHA-256 of the data, before any encryption by the client
+	Digest []byte
+	// ed25519 signature of the digest (see SignDigest) and the public key
+	// of the signer, if the client signed the data
+	Signature []byte
+	Signer    []byte
+	// number of files in a directory bundle
+	Files uint32
+	// SHA-256 of each of the members, if there are any
+	MemberDigests [][]byte
+}
+
+type PacketSendDataEndResponseEnum byte
+
+const (
+	// The item was stored
+	SendDataEndResponseOK PacketSendDataEndResponseEnum = iota
+	// The signature does not verify
+	SendDataEndResponseBadSignature
+	// The data received does not match the digest
+	SendDataEndResponseBadDigest
+	// The item could not be stored
+	SendDataEndResponseFailed
+)
+
+type PacketSendDataEndResponse struct {
+	Status PacketSendDataEndResponseEnum
+	Id     uint32
+}
+
+// PacketSendDigestRequest asks the server to store a new item with data
+// it already holds, identified by its SHA-256, so that it does not have to
+// be sent again. Only for data which is not encrypted by the client.
+type PacketSendDigestRequest struct {
+	Name     string
+	Filename string
+	Mode     uint32
+	ModTime  time.Time
+	Labels   []string
+	Meta     map[string]string
+	Note     string
+	Kind     string
+	Digest   []byte
+	// as in PacketSendDataEnd
+	Signature []byte
+	Signer    []byte
+}
+
+type PacketSendDigestResponseEnum byte
+
+const (
+	// The item was stored
+	SendDigestResponseOK PacketSendDigestResponseEnum = iota
+	// The server does not have the data, it will need to be sent
+	SendDigestResponseNotFound
+	// The signature does not verify
+	SendDigestResponseBadSignature
+)
+
+type PacketSendDigestResponse struct {
+	Status PacketSendDigestResponseEnum
+	Id     uint32
 }
 
 // PacketReceiveDataStart is sent from the server to the client when
 // the client asks for a file to be sent to them.
 type PacketReceiveDataStartRequest struct {
 	Id uint32
+	// the item with this name, instead of by Id
+	Name string
+	// a previous version of the name, rather than the current one
+	Version uint32
+	// just this member of an item sent from several files
+	Member string
+	// the newest item picked by this, instead of by Id or Name
+	Selector *Selector
 }
 
 type PacketReceiveDataStartResponseEnum byte
@@ -211,14 +417,34 @@ const (
 	ReceiveDataStartResponseOK PacketReceiveDataStartResponseEnum = iota
 	// No such file by index
 	ReceiveDataStartResponseNotFound
+	// The item does not have the member asked for
+	ReceiveDataStartResponseMemberNotFound
 )
 
 // PacketReceiveDataStartResponse is the response to the above packet.
 type PacketReceiveDataStartResponse struct {
-	Status    PacketReceiveDataStartResponseEnum
-	Filename  string
-	Kind      string
-	TotalSize uint32
+	Status     PacketReceiveDataStartResponseEnum
+	Id         uint32
+	Name       string
+	Filename   string
+	Mode       uint32    // as sent in the PacketSendDataStart
+	ModTime    time.Time // as sent in the PacketSendDataStart
+	Directory  bool      // as sent in the PacketSendDataStart
+	Files      uint32    // as sent in the PacketSendDataEnd
+	Kind       string
+	TotalSize  uint64
+	Encryption EncryptionEnum
+	Recipients []string
+	// as sent in the PacketSendDataEnd
+	Digest    []byte
+	Signature []byte
+	Signer    []byte
+	Members   []Member
+	// only the data of the member asked for follows, rather than the
+	// whole item. The server can only do this for an item which is not
+	// signed or encrypted by the client, as otherwise the member could
+	// not be checked against the signature, or decrypted.
+	MemberOnly bool
 }
 
 type PacketReceiveDataNext struct {
@@ -228,19 +454,112 @@ type PacketReceiveDataNext struct {
 }
 
 type PacketListData struct {
-	Id        uint32
-	Filename  string
-	FileSize  uint32
-	Timestamp time.Time
-	Kind      string
+	Id         uint32
+	Name       string // the name it was copied to, if any
+	Version    uint32 // the version of the name
+	Current    bool   // the available version of the name, in a history
+	Filename   string
+	FileSize   uint64
+	StoredSize uint64 // how much space it takes on the server
+	Timestamp  time.Time
+	Kind       string
+	BurnedAt   time.Time // only set for items in the trash
+	Encryption EncryptionEnum
+	Recipients []string
+	Signer     []byte // public key of the signer, if signed
+	Directory  bool   // a directory bundle, of this many files
+	Files      uint32
+	Members    []string // names of the members, if sent from several files
+	Labels     []string
+	Meta       map[string]string
+	Note       string
+}
+
+// A Selector picks items by what they are, rather than by id or name. An
+// item is selected if it matches every field which is set.
+type Selector struct {
+	// only the Offset-th newest of the items selected, counting from 0
+	Newest bool
+	Offset uint32
+	// shell patterns, matching the kind, the filename or name, and any
+	// of the labels
+	Kind  string
+	Name  string
+	Label string
+	// copied less than Since ago, and more than Before ago
+	Since  time.Duration
+	Before time.Duration
+}
+
+// PacketListRequest is sent after the start of a list of the items, or of
+// those in the trash, to choose which are listed.
+type PacketListRequest struct {
+	// list only the items which match all of these
+	Filter []Filter
+}
+
+// A Filter is one condition of a PacketListRequest, a shell pattern to
+// match the item's Key, which is one of label, kind, name, filename or
+// note, or otherwise a metadata key.
+type Filter struct {
+	Key     string
+	Pattern string
+}
+
+// PacketInfoRequest asks for the details of an item.
+type PacketInfoRequest struct {
+	Id      uint32
+	Name    string // the item with this name, instead of by Id
+	Version uint32 // a previous version of the name
+	// the newest item picked by this, instead of by Id or Name
+	Selector *Selector
+}
+
+type PacketInfoResponseEnum byte
+
+const (
+	InfoResponseOK PacketInfoResponseEnum = iota
+	// No such file by index
+	InfoResponseNotFound
+)
+
+type PacketInfoResponse struct {
+	Status  PacketInfoResponseEnum
+	Item    PacketListData
+	Members []Member
 }
 
+// PacketBurnRequest asks for an item, or several, to be burned. Burned
+// items go to the trash unless Purge is set, in which case they are
+// deleted permanently.
 type PacketBurnRequest struct {
-	Id uint32
+	Id      uint32
+	Name    string // the item with this name, instead of by Id
+	Version uint32 // only if it is this version of the name
+	Purge   bool
+	// every item picked by this, instead of by Id or Name
+	Selector *Selector
+	// the items with these ids, instead of by Id or Name
+	Ids []uint32
+	// report what would be burned, without burning anything
+	DryRun bool
 }
 
+// PacketBurnResponse reports what was burned. One is sent with the Result
+// for each item, so that any number of them can be reported, and then a
+// last one with Done set, and a Status of BurnResponseOK if everything
+// asked for was found.
 type PacketBurnResponse struct {
 	Status PacketBurnResponseEnum
+	Result *BurnResult
+	Done   bool
+}
+
+// A BurnResult is the outcome of burning one item.
+type BurnResult struct {
+	Id     uint32
+	Status PacketBurnResponseEnum
+	Item   PacketListData // the item burned, if it was found
 }
 
 type PacketBurnResponseEnum byte
@@ -251,3 +570,54 @@ const (
 	// No such file by index
 	BurnResponseNotFound
 )
+
+// PacketRestoreRequest asks for an item to be restored from the trash.
+type PacketRestoreRequest struct {
+	Id      uint32
+	Name    string // the item with this name, instead of by Id
+	Version uint32 // only if it is this version of the name
+	// the newest item in the trash picked by this, instead of by Id or Name
+	Selector *Selector
+}
+
+type PacketRestoreResponse struct {
+	Status PacketRestoreResponseEnum
+}
+
+type PacketRestoreResponseEnum byte
+
+const (
+	// File has been restored
+	RestoreResponseOK PacketRestoreResponseEnum = iota
+	// No such file in the trash
+	RestoreResponseNotFound
+)
+
+// PacketHistoryRequest asks for the versions kept of a name. The server
+// replies with a PacketListData for each, oldest first, and closes the
+// connection.
+type PacketHistoryRequest struct {
+	Name string
+}
+
+// PacketRollbackRequest asks for a previous version of a name to be made
+// the current one again. With no Version, it is the version replaced most
+// recently.
+type PacketRollbackRequest struct {
+	Name    string
+	Version uint32
+}
+
+type PacketRollbackResponse struct {
+	Status PacketRollbackResponseEnum
+	Item   PacketListData // the version which is now current
+}
+
+type PacketRollbackResponseEnum byte
+
+const (
+	// The version is now the current one
+	RollbackResponseOK PacketRollbackResponseEnum = iota
+	// No such version in the history
+	RollbackResponseNotFound
+)
@@ -2,7 +2,9 @@ package secure
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/gob"
+	"io"
 	"net"
 	"testing"
 	"time"
@@ -176,3 +178,76 @@ func BenchmarkPPS(b *testing.B) {
 		}
 	}
 }
+
+// bufferConn is a connection which just buffers what is written to it.
+type bufferConn struct {
+	bytes.Buffer
+}
+
+func (b *bufferConn) Close() error { return nil }
+
+func TestCompression(t *testing.T) {
+	key := &[32]byte{0x1, 0x2, 0x3}
+	text := bytes.Repeat([]byte("INSERT INTO users VALUES (1, 'someone');\n"), 300)
+	random := make([]byte, len(text))
+	_, _ = rand.Read(random)
+
+	for _, method := range SupportedCompression {
+		wire := &bufferConn{}
+		src := SecureConnection{Conn: wire, SharedKey: key, Buffer: &bytes.Buffer{}}
+		src.SetCompression(method)
+
+		_, _ = src.Write(text)
+		if wire.Len() >= len(text)/2 {
+			t.Errorf("%s: %d bytes of text took %d bytes on the wire", method, len(text), wire.Len())
+		}
+		before := wire.Len()
+		_, _ = src.Write(random)
+		if wire.Len()-before < len(random) {
+			t.Errorf("%s: random data was compressed", method)
+		}
+		src.SkipCompression(true)
+		before = wire.Len()
+		_, _ = src.Write(text)
+		if wire.Len()-before < len(text) {
+			t.Errorf("%s: text was compressed when skipping compression", method)
+		}
+
+		// the reader does not need to be told, and reads in small pieces
+		dst := SecureConnection{Conn: wire, SharedKey: key, Buffer: &bytes.Buffer{}}
+		got := []byte{}
+		buf := make([]byte, 100)
+		for {
+			n, err := dst.Read(buf)
+			got = append(got, buf[:n]...)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", method, err)
+			}
+		}
+		expected := append(append(append([]byte{}, text...), random...), text...)
+		if !bytes.Equal(got, expected) {
+			t.Errorf("%s: read %d bytes, not what was written", method, len(got))
+		}
+	}
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	if m := NegotiateCompression([]string{"brotli", CompressionGzip, CompressionZstd}); m != CompressionGzip {
+		t.Errorf("expected gzip, got %s", m)
+	}
+	if m := NegotiateCompression(nil); m != "" {
+		t.Errorf("expected no compression, got %s", m)
+	}
+}
+
+func TestFits(t *testing.T) {
+	if !Fits(PacketListData{Note: "small"}) {
+		t.Error("small packet does not fit")
+	}
+	if Fits(PacketListData{Note: string(make([]byte, MaxMessageSize))}) {
+		t.Error("large packet fits")
+	}
+}
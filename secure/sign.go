@@ -0,0 +1,24 @@
+package secure
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+)
+
+// signatureContext is prepended to digests before signing, so a signature
+// made by netgiv cannot be mistaken for one over anything else.
+const signatureContext = "netgiv signed digest v1\n"
+
+// SignDigest signs the SHA-256 digest of some content.
+func SignDigest(key ed25519.PrivateKey, digest []byte) []byte {
+	return ed25519.Sign(key, append([]byte(signatureContext), digest...))
+}
+
+// VerifyDigest reports whether signature is a valid signature of digest by
+// the ed25519 public key.
+func VerifyDigest(publicKey []byte, digest []byte, signature []byte) bool {
+	if len(publicKey) != ed25519.PublicKeySize || len(digest) != sha256.Size {
+		return false
+	}
+	return ed25519.Verify(publicKey, append([]byte(signatureContext), digest...), signature)
+}
@@ -0,0 +1,30 @@
+package secure
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"testing"
+)
+
+func TestSignDigest(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	otherPub, _, _ := ed25519.GenerateKey(nil)
+
+	digest := sha256.Sum256([]byte("hello"))
+	signature := SignDigest(priv, digest[:])
+
+	if !VerifyDigest(pub, digest[:], signature) {
+		t.Error("valid signature did not verify")
+	}
+	if VerifyDigest(otherPub, digest[:], signature) {
+		t.Error("signature verified with the wrong key")
+	}
+	tampered := sha256.Sum256([]byte("goodbye"))
+	if VerifyDigest(pub, tampered[:], signature) {
+		t.Error("signature verified for a different digest")
+	}
+	// a plain ed25519 signature of the digest is not a netgiv signature
+	if VerifyDigest(pub, digest[:], ed25519.Sign(priv, digest[:])) {
+		t.Error("signature without context verified")
+	}
+}
@@ -0,0 +1,243 @@
+package secure
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Streams are encrypted in segments, each sealed with secretbox. The nonce
+// for each segment is a random prefix (stored in the stream header),
+// followed by the segment number and a flag marking the final segment, so
+// segments cannot be reordered, and the stream cannot be truncated
+// without detection.
+const (
+	streamMagic       = "NGS1"
+	streamPrefixSize  = 16
+	StreamHeaderSize  = len(streamMagic) + streamPrefixSize
+	StreamSegmentSize = 64 * 1024
+	// each sealed segment is this much larger than its plaintext
+	StreamSegmentOverhead = secretbox.Overhead
+)
+
+// ErrStreamDecrypt is returned when a stream cannot be decrypted, because
+// the key is wrong or the data has been tampered with or truncated.
+var ErrStreamDecrypt = errors.New("could not decrypt stream")
+
+func streamNonce(prefix [streamPrefixSize]byte, segment uint64, last bool) *[24]byte {
+	var nonce [24]byte
+	copy(nonce[:], prefix[:])
+	binary.BigEndian.PutUint64(nonce[streamPrefixSize:], segment)
+	// segment numbers will never get near 2^56, so the top byte is free
+	if last {
+		nonce[streamPrefixSize] = 0x80
+	}
+	return &nonce
+}
+
+// StreamWriter encrypts everything written to it. Close must be called to
+// write the final segment.
+type StreamWriter struct {
+	w       io.Writer
+	key     *[32]byte
+	prefix  [streamPrefixSize]byte
+	segment uint64
+	buf     []byte
+	closed  bool
+}
+
+// NewStreamWriter writes a stream header to w, and returns a StreamWriter
+// which will encrypt data to w with key.
+func NewStreamWriter(w io.Writer, key *[32]byte) (*StreamWriter, error) {
+	s := &StreamWriter{w: w, key: key, buf: make([]byte, 0, StreamSegmentSize)}
+	_, _ = rand.Read(s.prefix[:])
+
+	_, err := w.Write(append([]byte(streamMagic), s.prefix[:]...))
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *StreamWriter) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, errors.New("write to closed stream")
+	}
+	written := 0
+	for len(p) > 0 {
+		n := copy(s.buf[len(s.buf):cap(s.buf)], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+		if len(s.buf) == cap(s.buf) {
+			err := s.seal(false)
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close writes the final segment. It does not close the underlying writer.
+func (s *StreamWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.seal(true)
+}
+
+func (s *StreamWriter) seal(last bool) error {
+	sealed := secretbox.Seal(nil, s.buf, streamNonce(s.prefix, s.segment, last), s.key)
+	s.segment++
+	s.buf = s.buf[:0]
+	_, err := s.w.Write(sealed)
+	return err
+}
+
+// StreamReader decrypts a stream written by a StreamWriter.
+type StreamReader struct {
+	r       *bufio.Reader
+	key     *[32]byte
+	prefix  [streamPrefixSize]byte
+	segment uint64
+	sealed  []byte
+	plain   []byte
+	done    bool
+}
+
+// NewStreamReader reads the stream header from r, and returns a
+// StreamReader which will decrypt the rest of r with key.
+func NewStreamReader(r io.Reader, key *[32]byte) (*StreamReader, error) {
+	header := make([]byte, StreamHeaderSize)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	if string(header[:len(streamMagic)]) != streamMagic {
+		return nil, ErrStreamDecrypt
+	}
+	s := &StreamReader{
+		r:      bufio.NewReader(r),
+		key:    key,
+		sealed: make([]byte, StreamSegmentSize+StreamSegmentOverhead),
+	}
+	copy(s.prefix[:], header[len(streamMagic):])
+	return s, nil
+}
+
+func (s *StreamReader) Read(p []byte) (int, error) {
+	for len(s.plain) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		err := s.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next segment.
+func (s *StreamReader) open() error {
+	n, err := io.ReadFull(s.r, s.sealed)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// a short segment must be the last one
+		s.done = true
+	} else if err != nil {
+		return err
+	} else if _, err := s.r.Peek(1); err == io.EOF {
+		// a full segment with nothing after it is also the last one
+		s.done = true
+	}
+
+	plain, ok := secretbox.Open(s.plain[:0], s.sealed[:n], streamNonce(s.prefix, s.segment, s.done), s.key)
+	if !ok {
+		return ErrStreamDecrypt
+	}
+	s.plain = plain
+	s.segment++
+	return nil
+}
+
+// skip discards n bytes of plaintext.
+func (s *StreamReader) skip(n int64) error {
+	_, err := io.CopyN(io.Discard, s, n)
+	return err
+}
+
+// OpenStreamAt opens a stream for reading from a plaintext offset, without
+// reading the segments before it. open is called to read the underlying
+// stream from a given offset, once for the header, and once from the
+// first segment needed.
+func OpenStreamAt(open func(offset int64) (io.ReadCloser, error), key *[32]byte, offset int64) (io.ReadCloser, error) {
+	r, err := open(0)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, StreamHeaderSize)
+	_, err = io.ReadFull(r, header)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	if offset < StreamSegmentSize {
+		// just carry on from here
+		s, err := NewStreamReader(io.MultiReader(bytes.NewReader(header), r), key)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		err = s.skip(offset)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		return streamReadCloser{s, r}, nil
+	}
+	r.Close()
+
+	segment := offset / StreamSegmentSize
+	r, err = open(int64(StreamHeaderSize) + segment*(StreamSegmentSize+StreamSegmentOverhead))
+	if err != nil {
+		return nil, err
+	}
+	s, err := NewStreamReader(io.MultiReader(bytes.NewReader(header), r), key)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	s.segment = uint64(segment)
+	err = s.skip(offset - segment*StreamSegmentSize)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return streamReadCloser{s, r}, nil
+}
+
+// StreamPlaintextSize returns the size of the plaintext of a stream of the
+// given (encrypted) size.
+func StreamPlaintextSize(size int64) int64 {
+	body := size - int64(StreamHeaderSize)
+	segments := body/(StreamSegmentSize+StreamSegmentOverhead) + 1
+	return body - segments*StreamSegmentOverhead
+}
+
+type streamReadCloser struct {
+	*StreamReader
+	c io.Closer
+}
+
+func (s streamReadCloser) Close() error {
+	return s.c.Close()
+}
@@ -0,0 +1,107 @@
+package secure
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func encryptStream(t *testing.T, key *[32]byte, data []byte) []byte {
+	t.Helper()
+	out := &bytes.Buffer{}
+	w, err := NewStreamWriter(out, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// write in odd sized chunks, to cross segment boundaries
+	for remaining := data; len(remaining) > 0; {
+		n := 7777
+		if n > len(remaining) {
+			n = len(remaining)
+		}
+		_, err := w.Write(remaining[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		remaining = remaining[n:]
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func TestStream(t *testing.T) {
+	key := NewDataKey()
+
+	for _, size := range []int{0, 1, StreamSegmentSize - 1, StreamSegmentSize, StreamSegmentSize + 1, StreamSegmentSize*3 + 100} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i % 253)
+		}
+		encrypted := encryptStream(t, key, data)
+
+		if got := StreamPlaintextSize(int64(len(encrypted))); got != int64(size) {
+			t.Errorf("size %d: StreamPlaintextSize returned %d", size, got)
+		}
+
+		r, err := NewStreamReader(bytes.NewReader(encrypted), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decrypted, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(data, decrypted) {
+			t.Errorf("size %d: decrypted data does not match", size)
+		}
+
+		for _, offset := range []int64{0, 1, StreamSegmentSize, StreamSegmentSize + 5, int64(size)} {
+			if offset > int64(size) {
+				continue
+			}
+			open := func(o int64) (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(encrypted[o:])), nil
+			}
+			r, err := OpenStreamAt(open, key, offset)
+			if err != nil {
+				t.Fatalf("size %d offset %d: %v", size, offset, err)
+			}
+			decrypted, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("size %d offset %d: %v", size, offset, err)
+			}
+			if !bytes.Equal(data[offset:], decrypted) {
+				t.Errorf("size %d offset %d: decrypted data does not match", size, offset)
+			}
+		}
+	}
+}
+
+func TestStreamTampering(t *testing.T) {
+	key := NewDataKey()
+	data := bytes.Repeat([]byte("x"), StreamSegmentSize*2+10)
+	encrypted := encryptStream(t, key, data)
+
+	tests := map[string]struct {
+		data []byte
+		key  *[32]byte
+	}{
+		"wrong key": {encrypted, NewDataKey()},
+		// drop the last segment entirely, so the stream ends on a full one
+		"truncated": {encrypted[:StreamHeaderSize+2*(StreamSegmentSize+StreamSegmentOverhead)], key},
+		"modified":  {append(append([]byte{}, encrypted[:100]...), append([]byte{encrypted[100] ^ 1}, encrypted[101:]...)...), key},
+	}
+	for name, test := range tests {
+		r, err := NewStreamReader(bytes.NewReader(test.data), test.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.ReadAll(r)
+		if err != ErrStreamDecrypt {
+			t.Errorf("%s: expected ErrStreamDecrypt, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tardisx/netgiv/secure"
+)
+
+// A selector picks items by what they are, rather than by id or name. It
+// is one or more terms separated by commas, all of which an item has to
+// match:
+//
+//	all              every item
+//	~N               the Nth newest item, counting from ~0 for the newest
+//	kind:PATTERN     the kind matches
+//	name:PATTERN     the filename, or the name it was copied to, matches
+//	label:PATTERN    one of the labels matches
+//	since:DURATION   copied less than this long ago
+//	before:DURATION  copied more than this long ago
+//
+// Patterns are shell patterns as in path.Match, and durations are as in
+// time.ParseDuration, or a number of days like "7d". Pasting takes the
+// newest item selected, where burning takes all of them.
+
+// isSelector returns true if s is a selector, rather than an id or name.
+// Names can't look like one.
+func isSelector(s string) bool {
+	return s == "all" || strings.HasPrefix(s, "~") || strings.Contains(s, ":")
+}
+
+// parseSelector parses a selector given to a flag.
+func parseSelector(s string) (*secure.Selector, error) {
+	sel := &secure.Selector{}
+	for _, term := range strings.Split(s, ",") {
+		if term == "all" {
+			continue
+		}
+		if strings.HasPrefix(term, "~") {
+			offset, err := strconv.ParseUint(term[1:], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("bad selector '%s', ~ needs a number", term)
+			}
+			sel.Offset = uint32(offset)
+			sel.Newest = true
+			continue
+		}
+		i := strings.Index(term, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("bad selector '%s', not ~N or key:value", term)
+		}
+		key, value := term[:i], term[i+1:]
+		var err error
+		switch key {
+		case "kind":
+			sel.Kind = value
+			_, err = path.Match(value, "")
+		case "name":
+			sel.Name = value
+			_, err = path.Match(value, "")
+		case "label":
+			sel.Label = value
+			_, err = path.Match(value, "")
+		case "since":
+			sel.Since, err = parseAge(value)
+		case "before":
+			sel.Before, err = parseAge(value)
+		default:
+			return nil, fmt.Errorf("bad selector '%s', unknown key '%s'", term, key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad selector '%s': %v", term, err)
+		}
+	}
+	return sel, nil
+}
+
+// parseAge parses a duration, which can also be a number of days.
+func parseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseUint(strings.TrimSuffix(s, "d"), 10, 16)
+		if err != nil {
+			return 0, fmt.Errorf("bad number of days '%s'", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, errors.New("duration must be more than 0")
+	}
+	return d, nil
+}
+
+// selected returns true if the NGF matches every term of the selector
+// but ~N, which depends on the other NGFs.
+func (ngf NGF) selected(sel *secure.Selector, now time.Time) bool {
+	match := func(pattern string, s string) bool {
+		ok, err := path.Match(pattern, s)
+		return err == nil && ok
+	}
+	if sel.Kind != "" && !match(sel.Kind, ngf.Kind) && !match(sel.Kind, kindMIME(ngf.Kind)) {
+		return false
+	}
+	if sel.Name != "" && !match(sel.Name, ngf.Filename) && !match(sel.Name, ngf.Name) {
+		return false
+	}
+	if sel.Label != "" {
+		found := false
+		for _, label := range ngf.Labels {
+			if match(sel.Label, label) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if sel.Since != 0 && !ngf.Timestamp.After(now.Add(-sel.Since)) {
+		return false
+	}
+	if sel.Before != 0 && !ngf.Timestamp.Before(now.Add(-sel.Before)) {
+		return false
+	}
+	return true
+}
+
+// selectIn returns the indexes of the NGFs selected, newest first.
+func selectIn(ngfs []*NGF, sel *secure.Selector, now time.Time) []int {
+	selected := []int{}
+	for i := len(ngfs) - 1; i >= 0; i-- {
+		if ngfs[i].selected(sel, now) {
+			selected = append(selected, i)
+		}
+	}
+	if sel.Newest {
+		if int(sel.Offset) >= len(selected) {
+			return nil
+		}
+		return selected[sel.Offset : sel.Offset+1]
+	}
+	return selected
+}
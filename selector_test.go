@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tardisx/netgiv/secure"
+	"github.com/tardisx/netgiv/storage"
+)
+
+func TestParseSelector(t *testing.T) {
+	sel, err := parseSelector("kind:image/*,name:*.sql,label:db,since:10m,before:2d,~1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := secure.Selector{Newest: true, Offset: 1, Kind: "image/*", Name: "*.sql", Label: "db", Since: 10 * time.Minute, Before: 48 * time.Hour}
+	if *sel != want {
+		t.Errorf("parsed as %+v", *sel)
+	}
+	for _, bad := range []string{"~", "~x", "foo:x", "kind", "kind:[", "since:x", "since:-1m", "before:xd", ""} {
+		if _, err := parseSelector(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestSelectIn(t *testing.T) {
+	now := time.Now()
+	ngfs := []*NGF{
+		{Id: 1, Kind: "image/png", Timestamp: now.Add(-48 * time.Hour)},
+		{Id: 2, Kind: "UTF-8 text", Filename: "dump.sql", Labels: []string{"db"}, Timestamp: now.Add(-time.Hour)},
+		{Id: 3, Kind: "image/png", Filename: "b.png", Timestamp: now.Add(-time.Minute)},
+		{Id: 4, Kind: "UTF-8 text", Name: "notes", Timestamp: now},
+	}
+	tests := []struct {
+		sel  string
+		want []uint32
+	}{
+		{"~0", []uint32{4}},
+		{"~1", []uint32{3}},
+		{"~9", nil},
+		{"kind:image/png", []uint32{3, 1}},
+		{"kind:image/png,~1", []uint32{1}},
+		{"kind:text/*", []uint32{4, 2}},
+		{"name:*.sql", []uint32{2}},
+		{"name:notes", []uint32{4}},
+		{"label:db", []uint32{2}},
+		{"since:10m", []uint32{4, 3}},
+		{"before:1d", []uint32{1}},
+		{"before:10m,since:1d", []uint32{2}},
+	}
+	for _, tc := range tests {
+		sel, err := parseSelector(tc.sel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []uint32{}
+		for _, i := range selectIn(ngfs, sel, now) {
+			got = append(got, ngfs[i].Id)
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("%s selected %v, want %v", tc.sel, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("%s selected %v, want %v", tc.sel, got, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestStoreBurnSelected(t *testing.T) {
+	s := store{backend: storage.NewMemory(0), trashRetention: time.Hour}
+	for id := uint32(1); id <= 4; id++ {
+		tempNGF(t, &s, id).Timestamp = time.Now()
+	}
+	s.ngfs[0].Timestamp = time.Now().Add(-48 * time.Hour)
+	s.ngfs[2].Timestamp = time.Now().Add(-48 * time.Hour)
+
+	sel, _ := parseSelector("before:1d")
+	burned := s.burnSelected(sel, false)
+	if len(burned) != 2 || burned[0].Id != 3 || burned[1].Id != 1 {
+		t.Errorf("burned %v", burned)
+	}
+	if len(s.list()) != 2 || len(s.listTrash()) != 2 {
+		t.Errorf("%d left, %d in the trash", len(s.list()), len(s.listTrash()))
+	}
+	if burned := s.burnSelected(sel, false); len(burned) != 0 {
+		t.Errorf("burned %v again", burned)
+	}
+}
@@ -2,47 +2,161 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/gob"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
-	"unicode/utf8"
 
 	log "github.com/sirupsen/logrus"
 
-	"github.com/h2non/filetype"
-
 	"github.com/tardisx/netgiv/secure"
+	"github.com/tardisx/netgiv/storage"
 )
 
 type Server struct {
-	port      int
-	authToken string
+	port            int
+	authToken       string
+	trashRetention  time.Duration
+	versions        int    // previous versions of each name kept
+	storageDir      string // where the index is kept, when persisting
+	backend         storage.Backend
+	orphans         string // what to do with unknown files found in the backend
+	shutdownTimeout time.Duration
+	persist         bool // keep stored files across restarts
+	compress        bool // compress data on the way to and from clients, if they can
+	compressStorage bool // compress stored data, if it is worth it
+	store           store
 }
 
 // An NGF is a Netgiv File
 type NGF struct {
-	Id        uint32
-	StorePath string
-	Filename  string // could be empty string if we were not supplied with one
-	Kind      string //
-	Size      uint64 // file size
-	Timestamp time.Time
+	Id       uint32
+	Name     string // the name it was copied to, if any
+	Version  uint32 // the version of the name, counting from 1
+	StoreKey string // key of the data in the storage backend
+	Filename string // could be empty string if we were not supplied with one
+	// Unix permission bits and modification time of the file, zero if it
+	// was not sent from a file
+	Mode    uint32
+	ModTime time.Time
+	// a bundle of a directory, and the number of files in it
+	Directory bool
+	Files     uint32
+	// the files it was sent from, if more than one
+	Members []secure.Member
+	// labels, metadata and a note given by the client
+	Labels []string
+	Meta   map[string]string
+	Note   string
+	Kind   string //
+	Size   uint64 // file size
+	// how the data is compressed in storage, if it is, and its size there
+	Compression string
+	StoredSize  uint64
+	// how the client encrypted the file, if it did
+	Encryption secure.EncryptionEnum
+	Recipients []string // who it was encrypted to, if anyone
+	Digest     []byte   // SHA-256 of the data, before any encryption by the client
+	Signature  []byte   // signature of the digest, if signed
+	Signer     []byte   // public key of the signer
+	Blob       string   // SHA-256 of the stored data, hex encoded
+	Timestamp  time.Time
+	BurnedAt   time.Time // when it was moved to the trash, zero if it has not been
+
+	readers int  // number of clients currently reading the file
+	purged  bool // removed from the store, file to be removed when readers reaches 0
 }
 
 func (ngf NGF) String() string {
-	return fmt.Sprintf("id: %d, stored: %s, size: %d, kind: %s", ngf.Id, ngf.StorePath, ngf.Size, ngf.Kind)
+	return fmt.Sprintf("id: %d, stored: %s, size: %d, kind: %s", ngf.Id, ngf.StoreKey, ngf.Size, ngf.Kind)
+}
+
+// receiveData is the response to a request to receive the NGF. It always
+// carries the id, so a client which has to hang up (to ask for a
+// passphrase, say) can ask for the same NGF again, however it was picked.
+func (ngf NGF) receiveData() secure.PacketReceiveDataStartResponse {
+	return secure.PacketReceiveDataStartResponse{
+		Status:     secure.ReceiveDataStartResponseOK,
+		Id:         ngf.Id,
+		Name:       ngf.Name,
+		Filename:   ngf.Filename,
+		Mode:       ngf.Mode,
+		ModTime:    ngf.ModTime,
+		Directory:  ngf.Directory,
+		Files:      ngf.Files,
+		Kind:       ngf.Kind,
+		TotalSize:  ngf.Size,
+		Encryption: ngf.Encryption,
+		Recipients: ngf.Recipients,
+		Digest:     ngf.Digest,
+		Signature:  ngf.Signature,
+		Signer:     ngf.Signer,
+		Members:    ngf.Members,
+	}
+}
+
+// infoData is the response to a request for info on the NGF. The names of
+// the members are only sent once, with the rest of their details.
+func (ngf NGF) infoData() secure.PacketInfoResponse {
+	item := ngf.listData()
+	item.Members = nil
+	return secure.PacketInfoResponse{Status: secure.InfoResponseOK, Item: item, Members: ngf.Members}
+}
+
+func (ngf NGF) listData() secure.PacketListData {
+	return secure.PacketListData{
+		Id:         ngf.Id,
+		Name:       ngf.Name,
+		Version:    ngf.Version,
+		Filename:   ngf.Filename,
+		FileSize:   ngf.Size,
+		StoredSize: ngf.StoredSize,
+		Timestamp:  ngf.Timestamp,
+		Kind:       ngf.Kind,
+		BurnedAt:   ngf.BurnedAt,
+		Encryption: ngf.Encryption,
+		Recipients: ngf.Recipients,
+		Signer:     ngf.Signer,
+		Directory:  ngf.Directory,
+		Files:      ngf.Files,
+		Members:    memberNames(ngf.Members),
+		Labels:     ngf.Labels,
+		Meta:       ngf.Meta,
+		Note:       ngf.Note,
+	}
 }
 
-var ngfs []NGF
 var globalId uint32
 
+// indexFilename is the name of the file in the storage dir where the
+// store is saved, when persist is enabled.
+const indexFilename = "index.json"
+
 func (s *Server) Run() {
 	log.Info(versionInfo(false))
+	s.store.backend = s.backend
+	s.store.trashRetention = s.trashRetention
+	s.store.versions = s.versions
+	s.loadIndex()
+	s.sweepOrphans()
+	if s.persist {
+		err := os.MkdirAll(s.storageDir, 0o700)
+		if err != nil {
+			log.Fatalf("could not create storage dir: %v", err)
+		}
+		s.store.indexPath = filepath.Join(s.storageDir, indexFilename)
+	}
+
 	log.Infof("starting server on :%d", s.port)
 	address := fmt.Sprintf(":%d", s.port)
 	networkAddress, _ := net.ResolveTCPAddr("tcp", address)
@@ -52,32 +166,158 @@ func (s *Server) Run() {
 		log.Fatalf("error creating listener: %v", err)
 	}
 
-	ngfs = make([]NGF, 0)
+	if s.store.trashRetention > 0 {
+		go func() {
+			for now := range time.Tick(time.Minute) {
+				s.store.expire(now)
+			}
+		}()
+	}
 
+	sigchan := make(chan os.Signal, 2)
+	signal.Notify(sigchan, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		sigchan := make(chan os.Signal, 1)
-		signal.Notify(sigchan, os.Interrupt)
-		<-sigchan
-
-		for _, ngf := range ngfs {
-			log.Printf("removing file: %s", ngf.StorePath)
-			err := os.Remove(ngf.StorePath)
-			if err != nil {
-				log.Errorf("could not remove %s: %v", ngf.StorePath, err)
-			}
-		}
-		os.Exit(0)
+		sig := <-sigchan
+		log.Printf("received %s, shutting down", sig)
+		// stop accepting new connections, existing ones carry on
+		listener.Close()
+
+		sig = <-sigchan
+		log.Errorf("received %s again, exiting immediately", sig)
+		os.Exit(1)
 	}()
 
 	// start main program tasks
 
+	var active sync.WaitGroup
 	for {
 		conn, err := listener.AcceptTCP()
+		if errors.Is(err, net.ErrClosed) {
+			break
+		}
 		if err != nil {
-			fmt.Print(err)
+			log.Errorf("error accepting connection: %v", err)
+			continue
+		}
+
+		active.Add(1)
+		go func() {
+			defer active.Done()
+			s.handleConnection(conn)
+		}()
+	}
+
+	os.Exit(s.shutdown(&active))
+}
+
+// shutdown waits up to shutdownTimeout for active connections to finish,
+// then either persists or removes the stored files. It returns the exit
+// status for the server.
+func (s *Server) shutdown(active *sync.WaitGroup) int {
+	status := 0
+
+	drained := make(chan struct{})
+	go func() {
+		active.Wait()
+		close(drained)
+	}()
+
+	log.Printf("waiting up to %s for transfers to finish", s.shutdownTimeout)
+	select {
+	case <-drained:
+		log.Printf("all transfers finished")
+	case <-time.After(s.shutdownTimeout):
+		log.Errorf("timed out waiting for transfers to finish")
+		status = 1
+	}
+
+	if !s.persist {
+		if s.store.removeAll() > 0 {
+			status = 1
+		}
+		return status
+	}
+
+	if s.store.removeTransient() > 0 {
+		status = 1
+	}
+	err := os.MkdirAll(s.storageDir, 0o700)
+	if err != nil {
+		log.Errorf("could not create storage dir: %v", err)
+		return 1
+	}
+	indexPath := filepath.Join(s.storageDir, indexFilename)
+	err = s.store.save(indexPath, atomic.LoadUint32(&globalId))
+	if err != nil {
+		log.Errorf("could not save index to %s: %v", indexPath, err)
+		return 1
+	}
+	log.Printf("saved index to %s", indexPath)
+	return status
+}
+
+// loadIndex restores the store from the index saved by a previous server
+// with persist enabled. The index is kept up to date while persisting, so
+// it is only removed once loaded when this server will not persist, so that
+// the files will be treated as orphans if it does not shut down cleanly.
+func (s *Server) loadIndex() {
+	indexPath := filepath.Join(s.storageDir, indexFilename)
+	lastId, err := s.store.load(indexPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		log.Errorf("could not load index from %s: %v", indexPath, err)
+		return
+	}
+	atomic.StoreUint32(&globalId, lastId)
+	log.Printf("loaded %d files from %s", len(s.store.list()), indexPath)
+	if s.persist {
+		return
+	}
+
+	err = os.Remove(indexPath)
+	if err != nil {
+		log.Errorf("could not remove %s: %v", indexPath, err)
+	}
+}
+
+// sweepOrphans looks for files in the storage backend which the server is
+// not tracking, left behind by a crash or a kill, and removes or
+// quarantines them.
+func (s *Server) sweepOrphans() {
+	keys, err := s.backend.List()
+	if err != nil {
+		log.Errorf("could not look for orphaned files: %v", err)
+		return
+	}
+
+	for _, key := range keys {
+		if s.store.knows(key) {
+			continue
+		}
+
+		if s.orphans == "quarantine" {
+			q, ok := s.backend.(storage.Quarantiner)
+			if ok {
+				log.Printf("quarantining orphaned file: %s", key)
+				err := q.Quarantine(key)
+				if err == nil {
+					continue
+				}
+				if !errors.Is(err, storage.ErrCannotQuarantine) {
+					log.Errorf("could not quarantine %s: %v", key, err)
+					continue
+				}
+			}
+			log.Errorf("storage backend cannot quarantine, removing instead")
 		}
 
-		go s.handleConnection(conn)
+		log.Printf("removing orphaned file: %s", key)
+		err := s.backend.Delete(key)
+		if err != nil {
+			log.Errorf("could not remove %s: %v", key, err)
+		}
 	}
 }
 
@@ -128,7 +368,11 @@ func (s *Server) handleConnection(conn *net.TCPConn) {
 
 	// otherwise we are good to continue, tell the client that
 	startResponse.Response = secure.PacketStartResponseEnumOK
+	if s.compress {
+		startResponse.Compression = secure.NegotiateCompression(start.Compression)
+	}
 	_ = enc.Encode(startResponse)
+	secureConnection.SetCompression(startResponse.Compression)
 
 	_ = conn.SetDeadline(time.Now().Add(time.Second * 5))
 
@@ -143,71 +387,167 @@ func (s *Server) handleConnection(conn *net.TCPConn) {
 			log.Errorf("error - expecting PacketSendDataStart: %v", err)
 			return
 		}
-		file, err := os.CreateTemp("", "netgiv_")
+		file, err := s.backend.Create()
 		if err != nil {
-			log.Fatalf("can't open tempfile: %v", err)
+			log.Errorf("can't create file in storage: %v", err)
+			return
 		}
-		defer file.Close()
+		// until it is added to the store, the file is removed on any failure
+		s.store.begin(file)
+		defer s.store.abandon(file.Key())
 
 		ngf := NGF{
-			StorePath: file.Name(),
-			Filename:  sendStart.Filename,
-			Kind:      "",
-			Size:      0,
-			Id:        atomic.AddUint32(&globalId, 1),
-			Timestamp: time.Now(),
+			Name:       sendStart.Name,
+			StoreKey:   file.Key(),
+			Filename:   cleanFilename(sendStart.Filename),
+			Mode:       sendStart.Mode & uint32(os.ModePerm),
+			ModTime:    sendStart.ModTime,
+			Directory:  sendStart.Directory,
+			Members:    cleanMembers(sendStart.Members),
+			Labels:     sendStart.Labels,
+			Meta:       sendStart.Meta,
+			Note:       sendStart.Note,
+			Kind:       sendStart.Kind,
+			Size:       0,
+			Encryption: sendStart.Encryption,
+			Recipients: sendStart.Recipients,
+			Id:         atomic.AddUint32(&globalId, 1),
+			Timestamp:  time.Now(),
 		}
 
-		if err != nil {
-			log.Errorf("got error with temp file: %v", err)
-			return
-		}
+		// data goes to the file through compression, if it is worth it,
+		// which is decided once we know the kind
+		stored := newStoredWriter(file, &ngf, s.compressStorage)
+		defer stored.Close()
+
 		sendData := secure.PacketSendDataNext{}
-		determinedKind := false
-		for {
+		hash := sha256.New()
+		// if the client told us the kind, we don't need to work it out
+		determinedKind := sendStart.Kind != ""
+		for !sendData.Last {
 			_ = conn.SetDeadline(time.Now().Add(time.Second * 5))
+			sendData = secure.PacketSendDataNext{}
 			err = dec.Decode(&sendData)
 			if err == io.EOF {
-				break
+				log.Errorf("client disconnected before finishing sending %s", file.Key())
+				return
 			}
 			if err != nil {
 				log.Errorf("error while expecting PacketSendDataNext: %s", err)
 				return
 			}
 
-			// filetype.Match needs a few hundred bytes - I guess there is a chance
+			// detectKind needs a few hundred bytes - I guess there is a chance
 			// we don't have enough in the very first packet? This might need rework.
-			if !determinedKind {
-				kind, _ := filetype.Match(sendData.Data)
-
-				if kind.MIME.Value == "" {
-					// this is pretty fragile. If our chunk boundary happens in the
-					// middle of an actual UTF-8 character, we will fail this test.
-					// However it's good for small chunks of text which fit in a
-					// single chunk, which I suspect to be a common use case.
-					if utf8.ValidString(string(sendData.Data)) {
-						ngf.Kind = "UTF-8 text"
-					}
-				} else {
-					ngf.Kind = kind.MIME.Value
-				}
-
+			if !determinedKind && len(sendData.Data) > 0 {
+				ngf.Kind = detectKind(sendData.Data)
 				determinedKind = true
 			}
 
-			_, _ = file.Write(sendData.Data)
+			_, err := stored.Write(sendData.Data)
+			if err != nil {
+				log.Errorf("error writing to %s: %v", file.Key(), err)
+				return
+			}
+			hash.Write(sendData.Data)
 		}
-		info, err := file.Stat()
+
+		err = stored.Close()
 		if err != nil {
-			log.Errorf("couldn't stat file %s", err)
+			log.Errorf("error writing to %s: %v", file.Key(), err)
 			return
 		}
-		ngf.Size = uint64(info.Size())
-		file.Close()
 
-		ngfs = append(ngfs, ngf)
+		sendEnd := secure.PacketSendDataEnd{}
+		err = dec.Decode(&sendEnd)
+		if err != nil {
+			log.Errorf("error while expecting PacketSendDataEnd: %s", err)
+			return
+		}
+		endResponse := secure.PacketSendDataEndResponse{Status: secure.SendDataEndResponseOK}
+		if len(sendEnd.Signature) > 0 && !secure.VerifyDigest(sendEnd.Signer, sendEnd.Digest, sendEnd.Signature) {
+			log.Errorf("bad signature on %s", file.Key())
+			endResponse.Status = secure.SendDataEndResponseBadSignature
+		} else if ngf.Encryption == 0 && !bytes.Equal(sendEnd.Digest, hash.Sum(nil)) {
+			// we can only check the digest if we can see the data
+			log.Errorf("data received for %s does not match the digest", file.Key())
+			endResponse.Status = secure.SendDataEndResponseBadDigest
+		} else if err := validName(ngf.Name); ngf.Name != "" && err != nil {
+			log.Errorf("bad name for %s: %v", file.Key(), err)
+			endResponse.Status = secure.SendDataEndResponseFailed
+		} else if err := validMetadata(ngf.Labels, ngf.Meta, ngf.Note); err != nil {
+			log.Errorf("bad metadata for %s: %v", file.Key(), err)
+			endResponse.Status = secure.SendDataEndResponseFailed
+		} else if err := validMembers(ngf.Members); err != nil {
+			log.Errorf("bad members for %s: %v", file.Key(), err)
+			endResponse.Status = secure.SendDataEndResponseFailed
+		} else if err := ngf.addMemberDigests(sendEnd.MemberDigests); err != nil {
+			log.Errorf("bad members for %s: %v", file.Key(), err)
+			endResponse.Status = secure.SendDataEndResponseFailed
+		} else if err := ngf.describable(); err != nil {
+			log.Errorf("bad description for %s: %v", file.Key(), err)
+			endResponse.Status = secure.SendDataEndResponseFailed
+		} else {
+			ngf.Digest = sendEnd.Digest
+			ngf.Signature = sendEnd.Signature
+			ngf.Signer = sendEnd.Signer
+			ngf.Files = sendEnd.Files
+			ngf.Blob = hex.EncodeToString(hash.Sum(nil))
+			err := s.store.commit(&ngf, file)
+			if err != nil {
+				log.Errorf("error storing %s: %v", file.Key(), err)
+				endResponse.Status = secure.SendDataEndResponseFailed
+			}
+		}
+		if endResponse.Status != secure.SendDataEndResponseOK {
+			_ = enc.Encode(endResponse)
+			return
+		}
 		log.Printf("done receiving file: %v", ngf)
 
+		endResponse.Id = ngf.Id
+		_ = enc.Encode(endResponse)
+
+		return
+	case secure.OperationTypeSendDigest:
+		req := secure.PacketSendDigestRequest{}
+		err := dec.Decode(&req)
+		if err != nil {
+			log.Errorf("error expecting PacketSendDigestRequest: %v", err)
+			return
+		}
+		res := secure.PacketSendDigestResponse{Status: secure.SendDigestResponseNotFound}
+		ngf := NGF{
+			Name:      req.Name,
+			Filename:  cleanFilename(req.Filename),
+			Mode:      req.Mode & uint32(os.ModePerm),
+			ModTime:   req.ModTime,
+			Labels:    req.Labels,
+			Meta:      req.Meta,
+			Note:      req.Note,
+			Kind:      req.Kind,
+			Digest:    req.Digest,
+			Signature: req.Signature,
+			Signer:    req.Signer,
+			Blob:      hex.EncodeToString(req.Digest),
+			Timestamp: time.Now(),
+		}
+		if len(req.Signature) > 0 && !secure.VerifyDigest(req.Signer, req.Digest, req.Signature) {
+			log.Errorf("bad signature on digest %s", ngf.Blob)
+			res.Status = secure.SendDigestResponseBadSignature
+		} else if err := validName(ngf.Name); ngf.Name != "" && err != nil {
+			// the upload will fail too, with the reason
+			log.Errorf("bad name for digest %s: %v", ngf.Blob, err)
+		} else if err := validMetadata(ngf.Labels, ngf.Meta, ngf.Note); err != nil {
+			log.Errorf("bad metadata for digest %s: %v", ngf.Blob, err)
+		} else if s.store.commitExisting(&ngf) {
+			log.Printf("stored file by digest: %v", ngf)
+			res.Status = secure.SendDigestResponseOK
+			res.Id = ngf.Id
+		} else {
+			log.Debugf("do not have digest %s", ngf.Blob)
+		}
+		_ = enc.Encode(res)
 		return
 	case secure.OperationTypeReceive:
 		log.Printf("client requesting file receive")
@@ -222,26 +562,16 @@ func (s *Server) handleConnection(conn *net.TCPConn) {
 		log.Debugf("The asked for %v", req)
 
 		// do we have this ngf by id?
-		var requestedNGF NGF
-
-		if len(ngfs) > 0 {
-			if req.Id == 0 {
-				// they want the most recent one
-				requestedNGF = ngfs[len(ngfs)-1]
-			} else {
-				for _, ngf := range ngfs {
-					if ngf.Id == req.Id {
-						requestedNGF = ngf
-					}
-				}
-			}
+		requestedNGF, found := s.store.acquire(ref{id: req.Id, name: req.Name, version: req.Version, sel: req.Selector})
+		if found {
+			defer s.store.release(requestedNGF.Id)
 		}
 
 		log.Debugf("going to deliver %v", requestedNGF)
 
-		if requestedNGF.Id == 0 {
+		if !found {
 			// not found
-			log.Errorf("user requested %d, not found", req.Id)
+			log.Errorf("user requested %s, not found", ref{id: req.Id, name: req.Name, version: req.Version, sel: req.Selector})
 			res := secure.PacketReceiveDataStartResponse{
 				Status: secure.ReceiveDataStartResponseNotFound,
 			}
@@ -253,29 +583,54 @@ func (s *Server) handleConnection(conn *net.TCPConn) {
 			return
 		}
 
-		res := secure.PacketReceiveDataStartResponse{
-			Status:    secure.ReceiveDataStartResponseOK,
-			Filename:  requestedNGF.Filename,
-			Kind:      requestedNGF.Kind,
-			TotalSize: uint32(requestedNGF.Size),
+		res := requestedNGF.receiveData()
+		// where the data to send starts, and how much of it to send, if
+		// only one member of the item is to be sent
+		offset, length := uint64(0), int64(-1)
+		kind := requestedNGF.Kind
+		if req.Member != "" {
+			member, memberOffset, ok := findMember(requestedNGF.Members, req.Member)
+			if !ok {
+				log.Errorf("user requested member %s of %d, not found", req.Member, requestedNGF.Id)
+				res = secure.PacketReceiveDataStartResponse{Status: secure.ReceiveDataStartResponseMemberNotFound, Members: requestedNGF.Members}
+			} else if requestedNGF.Encryption == 0 && len(requestedNGF.Signature) == 0 {
+				res.MemberOnly = true
+				offset, length = memberOffset, int64(member.Size)
+				kind = member.Kind
+			}
 		}
 		err = enc.Encode(res)
 		if err != nil {
 			log.Errorf("error sending PacketReceiveDataStartResponse: %v", err)
 			return
 		}
+		if res.Status != secure.ReceiveDataStartResponseOK {
+			return
+		}
 		// now just start sending the file in batches
-		buf := make([]byte, 2048)
-		filename := requestedNGF.StorePath
-		log.Debugf("opening %s", filename)
-		f, err := os.Open(filename)
+		if requestedNGF.Encryption != 0 || compressedKind(kind) {
+			secureConnection.SkipCompression(true)
+		}
+
+		buf := make([]byte, 16*1024)
+		key := requestedNGF.StoreKey
+		log.Debugf("opening %s", key)
+		f, err := openStored(s.backend, requestedNGF, offset)
 		if err != nil {
-			log.Errorf("could not find file %s: %v", filename, err)
+			log.Errorf("could not open file %s: %v", key, err)
 			return
 		}
+		defer f.Close()
+		var in io.Reader = f
+		if length >= 0 {
+			in = io.LimitReader(in, length)
+		}
 
 		for {
-			n, err := f.Read(buf)
+			n, err := io.ReadFull(in, buf)
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
 			eof := false
 
 			if err != nil && err != io.EOF {
@@ -293,7 +648,10 @@ func (s *Server) handleConnection(conn *net.TCPConn) {
 			}
 			err = enc.Encode(chunk)
 			if err != nil {
+				// the client hangs up without reading, e.g. when it needs
+				// a passphrase, so stop rather than read the whole item
 				log.Errorf("error sending chunk: %v", err)
+				return
 			}
 
 			if eof {
@@ -304,87 +662,171 @@ func (s *Server) handleConnection(conn *net.TCPConn) {
 		return
 	case secure.OperationTypeList:
 		log.Debugf("client requesting file list")
+		req := secure.PacketListRequest{}
+		err := dec.Decode(&req)
+		if err != nil {
+			log.Errorf("error expecting PacketListRequest: %v", err)
+			return
+		}
 
-		for _, ngf := range ngfs {
-			p := secure.PacketListData{}
-			p.FileSize = uint32(ngf.Size)
-			p.Kind = ngf.Kind
-			p.Id = ngf.Id
-			p.Filename = ngf.Filename
-			p.Timestamp = ngf.Timestamp
-			_ = enc.Encode(p)
+		for _, ngf := range s.store.list() {
+			if ngf.matches(req.Filter) {
+				_ = enc.Encode(ngf.listData())
+			}
 		}
 		log.Debugf("done sending list, closing connection")
 
 		return
-	case secure.OperationTypeBurn:
-		log.Debugf("client requesting burn")
-		// wait for them to send the request
-		req := secure.PacketBurnRequest{}
+	case secure.OperationTypeTrashList:
+		log.Debugf("client requesting trash list")
+		req := secure.PacketListRequest{}
 		err := dec.Decode(&req)
 		if err != nil {
-			log.Errorf("error expecting PacketBurnRequest: %v", err)
+			log.Errorf("error expecting PacketListRequest: %v", err)
 			return
 		}
 
-		log.Debugf("The client asked for %v to be burned", req)
-
-		// do we have this ngf by id?
-		var requestedNGF NGF
-
-		if len(ngfs) > 0 {
-			if req.Id == 0 {
-				// they want the most recent one
-				requestedNGF = ngfs[len(ngfs)-1]
-			} else {
-				for _, ngf := range ngfs {
-					if ngf.Id == req.Id {
-						requestedNGF = ngf
-					}
-				}
+		for _, ngf := range s.store.listTrash() {
+			if ngf.matches(req.Filter) {
+				_ = enc.Encode(ngf.listData())
 			}
 		}
+		log.Debugf("done sending trash list, closing connection")
 
-		log.Debugf("going to burn %v", requestedNGF)
+		return
+	case secure.OperationTypeInfo:
+		log.Debugf("client requesting item info")
+		req := secure.PacketInfoRequest{}
+		err := dec.Decode(&req)
+		if err != nil {
+			log.Errorf("error expecting PacketInfoRequest: %v", err)
+			return
+		}
 
-		if requestedNGF.Id == 0 {
-			// not found
-			log.Errorf("user requested burning %d, not found", req.Id)
-			res := secure.PacketBurnResponse{
-				Status: secure.BurnResponseNotFound,
-			}
-			err = enc.Encode(res)
-			if err != nil {
-				log.Errorf("could not send NotFound: %v", err)
-			}
+		res := secure.PacketInfoResponse{Status: secure.InfoResponseNotFound}
+		ngf, found := s.store.get(ref{id: req.Id, name: req.Name, version: req.Version, sel: req.Selector})
+		if !found {
+			log.Errorf("user requested info on %s, not found", ref{id: req.Id, name: req.Name, version: req.Version, sel: req.Selector})
+		} else {
+			res = ngf.infoData()
+		}
 
+		err = enc.Encode(res)
+		if err != nil {
+			log.Errorf("error sending PacketInfoResponse: %v", err)
+		}
+		return
+	case secure.OperationTypeRestore:
+		log.Debugf("client requesting restore")
+		req := secure.PacketRestoreRequest{}
+		err := dec.Decode(&req)
+		if err != nil {
+			log.Errorf("error expecting PacketRestoreRequest: %v", err)
 			return
 		}
 
-		// remove the file
-		err = os.Remove(requestedNGF.StorePath)
+		res := secure.PacketRestoreResponse{Status: secure.RestoreResponseOK}
+		restoredNGF, found := s.store.restore(ref{id: req.Id, name: req.Name, version: req.Version, sel: req.Selector})
+		if !found {
+			log.Errorf("user requested restoring %s, not found", ref{id: req.Id, name: req.Name, version: req.Version, sel: req.Selector})
+			res.Status = secure.RestoreResponseNotFound
+		} else {
+			log.Printf("restored: %v", restoredNGF)
+		}
+
+		err = enc.Encode(res)
+		if err != nil {
+			log.Errorf("error sending PacketRestoreResponse: %v", err)
+		}
+		return
+	case secure.OperationTypeHistory:
+		log.Debugf("client requesting history")
+		req := secure.PacketHistoryRequest{}
+		err := dec.Decode(&req)
 		if err != nil {
-			log.Errorf("could not remove file %s: %v", requestedNGF.StorePath, err)
+			log.Errorf("error expecting PacketHistoryRequest: %v", err)
 			return
 		}
 
-		// remove the ngf from the list
-		for i, ngf := range ngfs {
-			if ngf.Id == requestedNGF.Id {
-				ngfs = append(ngfs[:i], ngfs[i+1:]...)
-				break
-			}
+		versions, current := s.store.listVersions(req.Name)
+		for _, ngf := range versions {
+			item := ngf.listData()
+			item.Current = ngf.Id == current
+			_ = enc.Encode(item)
+		}
+		log.Debugf("done sending history, closing connection")
+
+		return
+	case secure.OperationTypeRollback:
+		log.Debugf("client requesting rollback")
+		req := secure.PacketRollbackRequest{}
+		err := dec.Decode(&req)
+		if err != nil {
+			log.Errorf("error expecting PacketRollbackRequest: %v", err)
+			return
 		}
 
-		res := secure.PacketBurnResponse{
-			Status: secure.BurnResponseOK,
+		res := secure.PacketRollbackResponse{Status: secure.RollbackResponseOK}
+		ngf, found := s.store.rollback(ref{name: req.Name, version: req.Version})
+		if !found {
+			log.Errorf("user requested rolling back to %s, not found", ref{name: req.Name, version: req.Version})
+			res.Status = secure.RollbackResponseNotFound
+		} else {
+			log.Printf("rolled back: %v", ngf)
+			res.Item = ngf.listData()
+			res.Item.Current = true
 		}
+
 		err = enc.Encode(res)
 		if err != nil {
-			log.Errorf("error sending PacketBurnResponse: %v", err)
+			log.Errorf("error sending PacketRollbackResponse: %v", err)
+		}
+		return
+	case secure.OperationTypeBurn:
+		log.Debugf("client requesting burn")
+		// wait for them to send the request
+		req := secure.PacketBurnRequest{}
+		err := dec.Decode(&req)
+		if err != nil {
+			log.Errorf("error expecting PacketBurnRequest: %v", err)
 			return
 		}
 
+		log.Debugf("The client asked for %v to be burned", req)
+
+		// move them to the trash (or remove them entirely if purging), if we
+		// have them. If one is currently being read, any removal will happen
+		// once the readers are done.
+		responses := s.burn(req)
+		requested := ref{id: req.Id, name: req.Name, version: req.Version, sel: req.Selector}
+		for _, res := range responses {
+			result := res.Result
+			if result == nil {
+				continue
+			}
+			switch {
+			case result.Status == secure.BurnResponseOK && req.DryRun:
+				log.Debugf("would burn %d", result.Id)
+			case result.Status == secure.BurnResponseOK:
+				log.Debugf("burned %d", result.Id)
+			case len(req.Ids) > 0:
+				log.Errorf("user requested burning %d, not found", result.Id)
+			default:
+				log.Errorf("user requested burning %s, not found", requested)
+			}
+		}
+		if len(responses) == 1 {
+			log.Errorf("user requested burning %s, nothing selected", requested)
+		}
+
+		for _, res := range responses {
+			err = enc.Encode(res)
+			if err != nil {
+				log.Errorf("error sending PacketBurnResponse: %v", err)
+				return
+			}
+		}
+
 		log.Printf("burn complete")
 		return
 	default:
@@ -392,3 +834,79 @@ func (s *Server) handleConnection(conn *net.TCPConn) {
 		return
 	}
 }
+
+// burn burns what a PacketBurnRequest asks for, or with DryRun, finds
+// what would be burned, and returns the responses to send: the outcome
+// for each item, then one with the status of the burn as a whole.
+func (s *Server) burn(req secure.PacketBurnRequest) []secure.PacketBurnResponse {
+	var responses []secure.PacketBurnResponse
+	res := secure.PacketBurnResponse{Status: secure.BurnResponseOK, Done: true}
+	found := func(ngf NGF) {
+		result := secure.BurnResult{Id: ngf.Id, Status: secure.BurnResponseOK, Item: ngf.listData()}
+		responses = append(responses, secure.PacketBurnResponse{Status: secure.BurnResponseOK, Result: &result})
+	}
+	notFound := func(id uint32) {
+		result := secure.BurnResult{Id: id, Status: secure.BurnResponseNotFound}
+		responses = append(responses, secure.PacketBurnResponse{Status: secure.BurnResponseNotFound, Result: &result})
+		res.Status = secure.BurnResponseNotFound
+	}
+
+	switch {
+	case len(req.Ids) > 0:
+		for _, id := range req.Ids {
+			var ngf NGF
+			var ok bool
+			if req.DryRun {
+				ngf, ok = s.store.wouldBurn(ref{id: id}, req.Purge)
+			} else {
+				ngf, ok = s.store.burn(ref{id: id}, req.Purge)
+			}
+			if ok {
+				found(ngf)
+			} else {
+				notFound(id)
+			}
+		}
+	case req.Selector != nil:
+		// a selector can pick any number of them
+		var ngfs []NGF
+		if req.DryRun {
+			ngfs = s.store.selected(req.Selector)
+		} else {
+			ngfs = s.store.burnSelected(req.Selector, req.Purge)
+		}
+		for _, ngf := range ngfs {
+			found(ngf)
+		}
+		if len(ngfs) == 0 {
+			res.Status = secure.BurnResponseNotFound
+		}
+	default:
+		r := ref{id: req.Id, name: req.Name, version: req.Version}
+		var ngf NGF
+		var ok bool
+		if req.DryRun {
+			ngf, ok = s.store.wouldBurn(r, req.Purge)
+		} else {
+			ngf, ok = s.store.burn(r, req.Purge)
+		}
+		if ok {
+			found(ngf)
+		} else {
+			notFound(req.Id)
+		}
+	}
+	return append(responses, res)
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
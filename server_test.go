@@ -0,0 +1,162 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tardisx/netgiv/secure"
+	"github.com/tardisx/netgiv/storage"
+)
+
+func TestSweepOrphans(t *testing.T) {
+	dir := t.TempDir()
+	backend, err := storage.NewFilesystem(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := Server{backend: backend, orphans: "quarantine"}
+	s.store.backend = backend
+	known := tempNGF(t, &s.store, 1)
+	orphan := tempFile(t, backend)
+	other := filepath.Join(dir, "something_else")
+	err = os.WriteFile(other, []byte("data"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.sweepOrphans()
+
+	if !exists(backend, known.StoreKey) {
+		t.Error("sweep removed a file it should not have")
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Error("sweep removed a file which is not ours")
+	}
+	if exists(backend, orphan) {
+		t.Error("orphan was not swept")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "quarantine", orphan)); err != nil {
+		t.Error("orphan was not quarantined")
+	}
+
+	s.orphans = "delete"
+	orphan = tempFile(t, backend)
+	s.sweepOrphans()
+	if exists(backend, orphan) {
+		t.Error("orphan was not removed")
+	}
+}
+
+func TestSweepOrphansCannotQuarantine(t *testing.T) {
+	backend := &storage.Encrypted{Backend: storage.NewMemory(0), Keyring: secure.NewKeyring("test", secure.NewDataKey())}
+	s := Server{backend: backend, orphans: "quarantine"}
+	s.store.backend = backend
+	orphan := tempFile(t, backend)
+
+	s.sweepOrphans()
+	if exists(backend, orphan) {
+		t.Error("orphan which could not be quarantined was not removed")
+	}
+}
+
+// burnResults checks the responses to a burn are sent as the protocol
+// says, and returns the status and results they carry.
+func burnResults(t *testing.T, responses []secure.PacketBurnResponse) (secure.PacketBurnResponseEnum, []secure.BurnResult) {
+	t.Helper()
+	results := []secure.BurnResult{}
+	for i, res := range responses {
+		if !secure.Fits(res) {
+			t.Fatalf("response %d is too large to send", i)
+		}
+		if res.Done != (i == len(responses)-1) {
+			t.Fatalf("response %d of %d has Done %v", i, len(responses), res.Done)
+		}
+		if res.Result != nil {
+			results = append(results, *res.Result)
+		}
+	}
+	return responses[len(responses)-1].Status, results
+}
+
+func TestServerBurn(t *testing.T) {
+	s := Server{}
+	s.store.backend = storage.NewMemory(0)
+	for id := uint32(1); id <= 4; id++ {
+		tempNGF(t, &s.store, id)
+	}
+
+	status, results := burnResults(t, s.burn(secure.PacketBurnRequest{Ids: []uint32{2, 3, 9}, DryRun: true}))
+	if status != secure.BurnResponseNotFound || len(results) != 3 {
+		t.Fatalf("dry run gave %v, %+v", status, results)
+	}
+	if results[0].Item.Id != 2 || results[2].Status != secure.BurnResponseNotFound {
+		t.Errorf("dry run results %+v", results)
+	}
+	if len(s.store.list()) != 4 {
+		t.Error("dry run burned something")
+	}
+
+	status, results = burnResults(t, s.burn(secure.PacketBurnRequest{Ids: []uint32{2, 3}}))
+	if status != secure.BurnResponseOK || len(results) != 2 || len(s.store.list()) != 2 {
+		t.Errorf("burning a list gave %v, %+v, leaving %d", status, results, len(s.store.list()))
+	}
+
+	all, _ := parseSelector("all")
+	status, results = burnResults(t, s.burn(secure.PacketBurnRequest{Selector: all}))
+	if status != secure.BurnResponseOK || len(results) != 2 || len(s.store.list()) != 0 {
+		t.Errorf("burning all gave %v, %+v, leaving %d", status, results, len(s.store.list()))
+	}
+	status, _ = burnResults(t, s.burn(secure.PacketBurnRequest{Selector: all}))
+	if status != secure.BurnResponseNotFound {
+		t.Errorf("burning all of nothing gave %v", status)
+	}
+}
+
+func TestServerBurnMany(t *testing.T) {
+	s := Server{}
+	s.store.backend = storage.NewMemory(0)
+	note := strings.Repeat("n", maxNoteLength)
+	for id := uint32(1); id <= 300; id++ {
+		tempNGF(t, &s.store, id).Note = note
+	}
+
+	all, _ := parseSelector("all")
+	for _, dryRun := range []bool{true, false} {
+		status, results := burnResults(t, s.burn(secure.PacketBurnRequest{Selector: all, DryRun: dryRun}))
+		if status != secure.BurnResponseOK || len(results) != 300 {
+			t.Errorf("burning all with dry run %v gave %v and %d results", dryRun, status, len(results))
+		}
+		if results[0].Item.Note != note {
+			t.Error("burned item is reported without its note")
+		}
+	}
+}
+
+func TestServerReceiveAgain(t *testing.T) {
+	s := Server{}
+	s.store.backend = storage.NewMemory(0)
+	s.store.versions = 1
+	namedNGF(t, &s.store, 1, "secret")
+	namedNGF(t, &s.store, 2, "secret")
+	tempNGF(t, &s.store, 3)
+
+	newest, _ := parseSelector("~1")
+	for _, r := range []ref{{name: "secret"}, {name: "secret", version: 1}, {sel: newest}, {}} {
+		ngf, ok := s.store.acquire(r)
+		if !ok {
+			t.Fatalf("could not acquire %s", r)
+		}
+		res := ngf.receiveData()
+		s.store.release(ngf.Id)
+
+		// a locked item is asked for again by the id in the response
+		again, ok := s.store.acquire(ref{id: res.Id})
+		if !ok || again.Id != ngf.Id {
+			t.Errorf("asking again for %s by id %d got %v", r, res.Id, again)
+			continue
+		}
+		s.store.release(again.Id)
+	}
+}
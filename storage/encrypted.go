@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/tardisx/netgiv/secure"
+)
+
+// encryptedMagic starts every object written by Encrypted.
+const encryptedMagic = "NGE1"
+
+// Encrypted wraps another Backend, encrypting objects at rest. Each object
+// is encrypted with its own random data key, which is stored in the
+// object header wrapped by a master key from the Keyring.
+type Encrypted struct {
+	Backend Backend
+	Keyring *secure.Keyring
+}
+
+func (e *Encrypted) Create() (Writer, error) {
+	w, err := e.Backend.Create()
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey := secure.NewDataKey()
+	id, wrapped := e.Keyring.Wrap(dataKey)
+	header := []byte(encryptedMagic)
+	header = append(header, byte(len(id)))
+	header = append(header, id...)
+	header = append(header, wrapped...)
+
+	_, err = w.Write(header)
+	if err != nil {
+		w.Abort()
+		return nil, err
+	}
+	stream, err := secure.NewStreamWriter(w, dataKey)
+	if err != nil {
+		w.Abort()
+		return nil, err
+	}
+	return &encryptedWriter{Writer: w, stream: stream}, nil
+}
+
+// readHeader reads the object header from r, returning the data key and
+// the length of the header.
+func (e *Encrypted) readHeader(r io.Reader) (*[32]byte, int64, error) {
+	start := make([]byte, len(encryptedMagic)+1)
+	_, err := io.ReadFull(r, start)
+	if err != nil {
+		return nil, 0, err
+	}
+	if string(start[:len(encryptedMagic)]) != encryptedMagic {
+		return nil, 0, errors.New("object is not encrypted")
+	}
+	rest := make([]byte, int(start[len(encryptedMagic)])+secure.WrappedKeySize)
+	_, err = io.ReadFull(r, rest)
+	if err != nil {
+		return nil, 0, err
+	}
+	idLen := int(start[len(encryptedMagic)])
+	dataKey, err := e.Keyring.Unwrap(string(rest[:idLen]), rest[idLen:])
+	if err != nil {
+		return nil, 0, err
+	}
+	return dataKey, int64(len(start) + len(rest)), nil
+}
+
+func (e *Encrypted) Open(key string, offset int64) (io.ReadCloser, error) {
+	r, err := e.Backend.Open(key, 0)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, headerSize, err := e.readHeader(r)
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("could not read header of %s: %v", key, err)
+	}
+
+	// the stream carries on from where we are in r, so use that rather
+	// than opening it again if we can
+	unused := r
+	open := func(streamOffset int64) (io.ReadCloser, error) {
+		if streamOffset == 0 && unused != nil {
+			r := unused
+			unused = nil
+			return r, nil
+		}
+		return e.Backend.Open(key, headerSize+streamOffset)
+	}
+	stream, err := secure.OpenStreamAt(open, dataKey, offset)
+	if unused != nil {
+		unused.Close()
+	}
+	return stream, err
+}
+
+func (e *Encrypted) Delete(key string) error {
+	return e.Backend.Delete(key)
+}
+
+func (e *Encrypted) Stat(key string) (Info, error) {
+	info, err := e.Backend.Stat(key)
+	if err != nil {
+		return Info{}, err
+	}
+	r, err := e.Backend.Open(key, 0)
+	if err != nil {
+		return Info{}, err
+	}
+	defer r.Close()
+	_, headerSize, err := e.readHeader(r)
+	if err != nil {
+		return Info{}, fmt.Errorf("could not read header of %s: %v", key, err)
+	}
+	info.Size = secure.StreamPlaintextSize(info.Size - headerSize)
+	return info, nil
+}
+
+func (e *Encrypted) List() ([]string, error) {
+	return e.Backend.List()
+}
+
+// Quarantine quarantines the object in the wrapped Backend, if it can.
+func (e *Encrypted) Quarantine(key string) error {
+	q, ok := e.Backend.(Quarantiner)
+	if !ok {
+		return ErrCannotQuarantine
+	}
+	return q.Quarantine(key)
+}
+
+type encryptedWriter struct {
+	Writer
+	stream *secure.StreamWriter
+}
+
+func (w *encryptedWriter) Write(p []byte) (int, error) {
+	return w.stream.Write(p)
+}
+
+func (w *encryptedWriter) Commit() error {
+	err := w.stream.Close()
+	if err != nil {
+		w.Writer.Abort()
+		return err
+	}
+	return w.Writer.Commit()
+}
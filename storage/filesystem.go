@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Filesystem stores objects as files in a directory.
+type Filesystem struct {
+	Dir string
+}
+
+// NewFilesystem returns a Filesystem backend storing files in dir, which
+// is created if necessary.
+func NewFilesystem(dir string) (*Filesystem, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+	return &Filesystem{Dir: dir}, nil
+}
+
+func (f *Filesystem) path(key string) (string, error) {
+	if !strings.HasPrefix(key, KeyPrefix) || strings.ContainsAny(key, `/\`) {
+		return "", fmt.Errorf("bad key %q", key)
+	}
+	return filepath.Join(f.Dir, key), nil
+}
+
+func (f *Filesystem) Create() (Writer, error) {
+	file, err := os.CreateTemp(f.Dir, KeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	return &filesystemWriter{file: file}, nil
+}
+
+func (f *Filesystem) Open(key string, offset int64) (io.ReadCloser, error) {
+	path, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		_, err = file.Seek(offset, io.SeekStart)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return file, nil
+}
+
+func (f *Filesystem) Delete(key string) error {
+	path, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (f *Filesystem) Stat(key string) (Info, error) {
+	path, err := f.path(key)
+	if err != nil {
+		return Info{}, err
+	}
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Info{}, ErrNotFound
+	}
+	if err != nil {
+		return Info{}, err
+	}
+	return Info{Size: info.Size()}, nil
+}
+
+func (f *Filesystem) List() ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(f.Dir, KeyPrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(matches))
+	for _, match := range matches {
+		keys = append(keys, filepath.Base(match))
+	}
+	return keys, nil
+}
+
+// Quarantine moves the file into a quarantine subdirectory.
+func (f *Filesystem) Quarantine(key string) error {
+	path, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	quarantineDir := filepath.Join(f.Dir, "quarantine")
+	err = os.MkdirAll(quarantineDir, 0o700)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path, filepath.Join(quarantineDir, key))
+}
+
+type filesystemWriter struct {
+	file *os.File
+	done bool
+}
+
+func (w *filesystemWriter) Write(p []byte) (int, error) {
+	return w.file.Write(p)
+}
+
+func (w *filesystemWriter) Key() string {
+	return filepath.Base(w.file.Name())
+}
+
+func (w *filesystemWriter) Commit() error {
+	w.done = true
+	return w.file.Close()
+}
+
+func (w *filesystemWriter) Abort() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	w.file.Close()
+	return os.Remove(w.file.Name())
+}
@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+)
+
+// ErrTooLarge is returned when writing more than MaxSize bytes to a
+// Memory object.
+var ErrTooLarge = errors.New("object too large for memory storage")
+
+// Memory stores objects in memory. It is suitable for small items, and
+// for tests.
+type Memory struct {
+	// MaxSize is the largest object which may be stored, 0 for no limit.
+	MaxSize int64
+
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func NewMemory(maxSize int64) *Memory {
+	return &Memory{MaxSize: maxSize, objects: make(map[string][]byte)}
+}
+
+func (m *Memory) Create() (Writer, error) {
+	return &memoryWriter{m: m, key: newKey()}, nil
+}
+
+func (m *Memory) Open(key string, offset int64) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, ok := m.objects[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return io.NopCloser(bytes.NewReader(data[offset:])), nil
+}
+
+func (m *Memory) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.objects[key]; !ok {
+		return ErrNotFound
+	}
+	delete(m.objects, key)
+	return nil
+}
+
+func (m *Memory) Stat(key string) (Info, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, ok := m.objects[key]
+	if !ok {
+		return Info{}, ErrNotFound
+	}
+	return Info{Size: int64(len(data))}, nil
+}
+
+func (m *Memory) List() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]string, 0, len(m.objects))
+	for key := range m.objects {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+type memoryWriter struct {
+	m   *Memory
+	key string
+	buf bytes.Buffer
+}
+
+func (w *memoryWriter) Write(p []byte) (int, error) {
+	if w.m.MaxSize > 0 && int64(w.buf.Len()+len(p)) > w.m.MaxSize {
+		return 0, ErrTooLarge
+	}
+	return w.buf.Write(p)
+}
+
+func (w *memoryWriter) Key() string {
+	return w.key
+}
+
+func (w *memoryWriter) Commit() error {
+	w.m.mu.Lock()
+	defer w.m.mu.Unlock()
+	w.m.objects[w.key] = w.buf.Bytes()
+	return nil
+}
+
+func (w *memoryWriter) Abort() error {
+	w.buf = bytes.Buffer{}
+	return nil
+}
@@ -0,0 +1,409 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3PartSize is the size of each part of a multipart upload. S3 requires
+// all but the last part to be at least 5MiB.
+const s3PartSize = 5 * 1024 * 1024
+
+// S3 stores objects in a bucket on an S3 compatible object store (AWS,
+// MinIO, Ceph and so on). Requests are signed with AWS Signature Version 4.
+type S3 struct {
+	// Endpoint is the base URL of the object store, like
+	// https://s3.eu-west-1.amazonaws.com or http://minio.local:9000
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	// Prefix is prepended to every object key, so netgiv can share a bucket.
+	Prefix string
+	// PathStyle addresses the bucket as part of the path, rather than as a
+	// subdomain of the endpoint. Most self-hosted object stores need this.
+	PathStyle bool
+
+	Client *http.Client
+}
+
+// s3Error is the error document returned by S3 for failed requests.
+type s3Error struct {
+	Code    string
+	Message string
+}
+
+func (s *S3) Create() (Writer, error) {
+	return &s3Writer{s3: s, key: newKey()}, nil
+}
+
+func (s *S3) Open(key string, offset int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	res, err := s.do(http.MethodGet, key, nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// offset is at (or beyond) the end of the object
+		res.Body.Close()
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	err = s.check(res, http.StatusOK, http.StatusPartialContent)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (s *S3) Delete(key string) error {
+	// S3 does not tell us if the object did not exist, so we need to check
+	_, err := s.Stat(key)
+	if err != nil {
+		return err
+	}
+	res, err := s.do(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return s.check(res, http.StatusNoContent, http.StatusOK)
+}
+
+func (s *S3) Stat(key string) (Info, error) {
+	res, err := s.do(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return Info{}, err
+	}
+	defer res.Body.Close()
+	err = s.check(res, http.StatusOK)
+	if err != nil {
+		return Info{}, err
+	}
+	return Info{Size: res.ContentLength}, nil
+}
+
+func (s *S3) List() ([]string, error) {
+	keys := []string{}
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", s.Prefix+KeyPrefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		res, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		err = s.check(res, http.StatusOK)
+		if err != nil {
+			return nil, err
+		}
+
+		result := struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}{}
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("could not decode bucket list: %v", err)
+		}
+		for _, obj := range result.Contents {
+			keys = append(keys, strings.TrimPrefix(obj.Key, s.Prefix))
+		}
+		if !result.IsTruncated {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// Quarantine moves the object under a quarantine/ prefix.
+func (s *S3) Quarantine(key string) error {
+	header := http.Header{}
+	header.Set("x-amz-copy-source", "/"+s.Bucket+"/"+s.Prefix+key)
+	res, err := s.do(http.MethodPut, "quarantine/"+key, nil, header, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	err = s.check(res, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	return s.Delete(key)
+}
+
+// check returns an error if the response status is not one of those
+// expected, closing the body.
+func (s *S3) check(res *http.Response, expected ...int) error {
+	for _, status := range expected {
+		if res.StatusCode == status {
+			return nil
+		}
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	s3err := s3Error{}
+	if xml.NewDecoder(res.Body).Decode(&s3err) == nil && s3err.Code != "" {
+		return fmt.Errorf("s3: %s: %s", s3err.Code, s3err.Message)
+	}
+	return fmt.Errorf("s3: unexpected status %s", res.Status)
+}
+
+// do makes a signed request for the object key (or the bucket itself, if
+// key is empty).
+func (s *S3) do(method string, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	path := "/"
+	if key != "" {
+		path += s.Prefix + key
+	}
+	if s.PathStyle {
+		u.Path = "/" + s.Bucket + path
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+		u.Path = path
+	}
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s.sign(req, body, time.Now().UTC())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// sign adds AWS Signature Version 4 headers to the request.
+func (s *S3) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	// canonical headers are every header we set, in lower case and sorted
+	names := []string{}
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20"),
+		canonicalHeaders,
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Writer buffers writes in memory, uploading them as a multipart upload
+// once they exceed a single part. Small objects are uploaded with a single
+// PUT on commit.
+type s3Writer struct {
+	s3       *S3
+	key      string
+	buf      bytes.Buffer
+	uploadId string
+	etags    []string
+	done     bool
+}
+
+func (w *s3Writer) Key() string {
+	return w.key
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	n, _ := w.buf.Write(p)
+	for w.buf.Len() >= s3PartSize {
+		err := w.uploadPart(w.buf.Next(s3PartSize))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+func (w *s3Writer) uploadPart(part []byte) error {
+	if w.uploadId == "" {
+		query := url.Values{}
+		query.Set("uploads", "")
+		res, err := w.s3.do(http.MethodPost, w.key, query, nil, nil)
+		if err != nil {
+			return err
+		}
+		err = w.s3.check(res, http.StatusOK)
+		if err != nil {
+			return err
+		}
+		result := struct {
+			UploadId string
+		}{}
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil || result.UploadId == "" {
+			return fmt.Errorf("could not start multipart upload: %v", err)
+		}
+		w.uploadId = result.UploadId
+	}
+
+	query := url.Values{}
+	query.Set("partNumber", strconv.Itoa(len(w.etags)+1))
+	query.Set("uploadId", w.uploadId)
+	res, err := w.s3.do(http.MethodPut, w.key, query, nil, part)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	err = w.s3.check(res, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	w.etags = append(w.etags, res.Header.Get("ETag"))
+	return nil
+}
+
+func (w *s3Writer) Commit() error {
+	if w.done {
+		return errors.New("already committed or aborted")
+	}
+	w.done = true
+
+	if w.uploadId == "" {
+		res, err := w.s3.do(http.MethodPut, w.key, nil, nil, w.buf.Bytes())
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		return w.s3.check(res, http.StatusOK)
+	}
+
+	if w.buf.Len() > 0 {
+		err := w.uploadPart(w.buf.Bytes())
+		if err != nil {
+			w.abortUpload()
+			return err
+		}
+	}
+
+	type completedPart struct {
+		PartNumber int
+		ETag       string
+	}
+	complete := struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{}
+	for i, etag := range w.etags {
+		complete.Parts = append(complete.Parts, completedPart{PartNumber: i + 1, ETag: etag})
+	}
+	body, _ := xml.Marshal(complete)
+
+	query := url.Values{}
+	query.Set("uploadId", w.uploadId)
+	res, err := w.s3.do(http.MethodPost, w.key, query, nil, body)
+	if err != nil {
+		w.abortUpload()
+		return err
+	}
+	err = w.s3.check(res, http.StatusOK)
+	if err != nil {
+		w.abortUpload()
+		return err
+	}
+	// S3 can report an error in the body of a 200 response to this request
+	s3err := s3Error{}
+	decodeErr := xml.NewDecoder(res.Body).Decode(&s3err)
+	res.Body.Close()
+	if decodeErr == nil && s3err.Code != "" {
+		return fmt.Errorf("s3: %s: %s", s3err.Code, s3err.Message)
+	}
+	return nil
+}
+
+func (w *s3Writer) Abort() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	w.buf = bytes.Buffer{}
+	if w.uploadId != "" {
+		return w.abortUpload()
+	}
+	return nil
+}
+
+func (w *s3Writer) abortUpload() error {
+	query := url.Values{}
+	query.Set("uploadId", w.uploadId)
+	res, err := w.s3.do(http.MethodDelete, w.key, query, nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return w.s3.check(res, http.StatusNoContent, http.StatusOK)
+}
@@ -0,0 +1,66 @@
+// Package storage provides the backends the netgiv server uses to store
+// the data for items.
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+)
+
+// KeyPrefix is the prefix of every key created by a backend. Anything
+// else found in a backend is not ours, and is left alone.
+const KeyPrefix = "netgiv_"
+
+// ErrNotFound is returned when a key does not exist in the backend.
+var ErrNotFound = errors.New("not found")
+
+// A Backend stores objects, identified by a key chosen by the backend.
+type Backend interface {
+	// Create starts a new object. Nothing is visible via Open, Stat or List
+	// until the writer is committed.
+	Create() (Writer, error)
+	// Open returns a reader for the object, starting offset bytes in.
+	Open(key string, offset int64) (io.ReadCloser, error)
+	// Delete removes the object.
+	Delete(key string) error
+	// Stat returns information about the object.
+	Stat(key string) (Info, error)
+	// List returns the keys of all objects in the backend.
+	List() ([]string, error)
+}
+
+// A Writer receives the data for a new object.
+type Writer interface {
+	io.Writer
+	// Key returns the key the object will have once committed.
+	Key() string
+	// Commit finishes the object, making it available.
+	Commit() error
+	// Abort discards the object. It is safe to call after Commit, in which
+	// case it does nothing.
+	Abort() error
+}
+
+// ErrCannotQuarantine is returned by a Quarantiner which wraps a Backend
+// that cannot quarantine.
+var ErrCannotQuarantine = errors.New("storage backend cannot quarantine")
+
+// A Quarantiner is a Backend which can move objects out of the way,
+// without deleting them.
+type Quarantiner interface {
+	Quarantine(key string) error
+}
+
+// Info describes a stored object.
+type Info struct {
+	Size int64
+}
+
+// newKey returns a new random key.
+func newKey() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return KeyPrefix + hex.EncodeToString(b)
+}
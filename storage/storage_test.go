@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/tardisx/netgiv/secure"
+)
+
+// testBackend runs the same set of checks against any backend.
+func testBackend(t *testing.T, b Backend, size int) {
+	t.Helper()
+
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	w, err := b.Create()
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	// write in odd sized chunks
+	for remaining := data; len(remaining) > 0; {
+		n := 1000
+		if n > len(remaining) {
+			n = len(remaining)
+		}
+		_, err := w.Write(remaining[:n])
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		remaining = remaining[n:]
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	key := w.Key()
+
+	info, err := b.Stat(key)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if info.Size != int64(size) {
+		t.Errorf("expected size %d, got %d", size, info.Size)
+	}
+
+	for _, offset := range []int64{0, 1, int64(size / 2), int64(size)} {
+		r, err := b.Open(key, offset)
+		if err != nil {
+			t.Fatalf("open at %d: %v", offset, err)
+		}
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("read at %d: %v", offset, err)
+		}
+		if !bytes.Equal(got, data[offset:]) {
+			t.Errorf("data read from offset %d does not match", offset)
+		}
+	}
+
+	// an aborted object never appears
+	aborted, err := b.Create()
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	_, _ = aborted.Write([]byte("discard me"))
+	if err := aborted.Abort(); err != nil {
+		t.Errorf("abort: %v", err)
+	}
+
+	keys, err := b.List()
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	sort.Strings(keys)
+	if len(keys) != 1 || keys[0] != key {
+		t.Errorf("expected list to be [%s], got %v", key, keys)
+	}
+
+	if err := b.Delete(key); err != nil {
+		t.Errorf("delete: %v", err)
+	}
+	if _, err := b.Stat(key); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound after delete, got %v", err)
+	}
+	if _, err := b.Open(key, 0); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound opening deleted key, got %v", err)
+	}
+	if err := b.Delete(key); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound deleting twice, got %v", err)
+	}
+}
+
+func TestFilesystem(t *testing.T) {
+	b, err := NewFilesystem(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBackend(t, b, 100000)
+
+	if _, err := b.Open("../etc/passwd", 0); err == nil {
+		t.Error("was able to open a key outside the storage dir")
+	}
+}
+
+func TestMemory(t *testing.T) {
+	testBackend(t, NewMemory(0), 100000)
+
+	m := NewMemory(10)
+	w, _ := m.Create()
+	if _, err := w.Write([]byte("more than ten bytes")); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("expected ErrTooLarge, got %v", err)
+	}
+}
+
+func TestEncrypted(t *testing.T) {
+	inner := NewMemory(0)
+	e := &Encrypted{Backend: inner, Keyring: secure.NewKeyring("test", secure.NewDataKey())}
+	testBackend(t, e, 200000)
+
+	w, _ := e.Create()
+	_, _ = w.Write([]byte("secret data"))
+	_ = w.Commit()
+
+	r, _ := inner.Open(w.Key(), 0)
+	raw, _ := io.ReadAll(r)
+	if bytes.Contains(raw, []byte("secret")) {
+		t.Error("data is not encrypted at rest")
+	}
+
+	other := &Encrypted{Backend: inner, Keyring: secure.NewKeyring("test", secure.NewDataKey())}
+	if _, err := other.Open(w.Key(), 0); err == nil {
+		t.Error("opened with the wrong master key")
+	}
+
+	if err := e.Quarantine(w.Key()); !errors.Is(err, ErrCannotQuarantine) {
+		t.Errorf("expected ErrCannotQuarantine from memory, got %v", err)
+	}
+	dir := t.TempDir()
+	fs, err := NewFilesystem(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e = &Encrypted{Backend: fs, Keyring: e.Keyring}
+	w, _ = e.Create()
+	_, _ = w.Write([]byte("secret data"))
+	_ = w.Commit()
+	if err := e.Quarantine(w.Key()); err != nil {
+		t.Errorf("could not quarantine in the filesystem: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "quarantine", w.Key())); err != nil {
+		t.Error("object was not quarantined")
+	}
+}
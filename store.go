@@ -0,0 +1,778 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/tardisx/netgiv/secure"
+	"github.com/tardisx/netgiv/storage"
+)
+
+// store holds the NGFs available on the server. NGFs handed out by the
+// store are reference counted, so that purging an item while another
+// client is still reading it only removes it from view - the stored data
+// is removed from the backend once the last reader has finished with it.
+//
+// Burned NGFs are moved to the trash, where they stay for trashRetention
+// before being purged, unless they are restored first.
+//
+// NGFs can be copied to a name, which refers to the most recent one
+// copied to it. Each NGF copied to a name is given the next version
+// number for the name. When a named NGF is replaced by a newer one, it
+// goes to the history, where the last few versions of each name are kept,
+// and from where it can be rolled back to.
+//
+// Identical data is only stored once. Each distinct blob of data is known
+// by its SHA-256, and is shared by every NGF with that content, being
+// removed from the backend when the last of them is purged.
+type store struct {
+	mu      sync.Mutex
+	backend storage.Backend
+	ngfs    []*NGF
+	// burned NGFs, waiting to expire or be restored
+	trash []*NGF
+	// previous versions of named NGFs, oldest first
+	history []*NGF
+	// purged NGFs still being read
+	purging []*NGF
+	// writers for files still being received, by store key
+	inflight map[string]storage.Writer
+	// stored data, by SHA-256
+	blobs map[string]*blob
+	// how long burned NGFs are kept, 0 to purge them immediately
+	trashRetention time.Duration
+	// how many previous versions of each name are kept
+	versions int
+	// where the index is kept up to date, when persisting
+	indexPath string
+}
+
+// ref identifies an NGF by its id, or the name it was copied to, and
+// optionally the version of that name, or by a selector. With none of
+// them, it is the most recent.
+type ref struct {
+	id      uint32
+	name    string
+	version uint32
+	sel     *secure.Selector
+}
+
+func (r ref) String() string {
+	if r.sel != nil {
+		return fmt.Sprintf("%+v", *r.sel)
+	}
+	if r.name != "" && r.version != 0 {
+		return r.name + "@" + strconv.FormatUint(uint64(r.version), 10)
+	}
+	if r.name != "" {
+		return r.name
+	}
+	return strconv.FormatUint(uint64(r.id), 10)
+}
+
+// blob is some data in the backend, shared by one or more NGFs.
+type blob struct {
+	key         string
+	size        uint64
+	storedSize  uint64
+	compression string
+	refs        int // NGFs using it, including those in the trash or being purged
+}
+
+// use points an NGF at the blob's data.
+func (b *blob) use(ngf *NGF) {
+	b.refs++
+	ngf.StoreKey = b.key
+	ngf.Size = b.size
+	ngf.StoredSize = b.storedSize
+	ngf.Compression = b.compression
+}
+
+// begin registers a file which is in the process of being received, so
+// that it can be cleaned up if the server shuts down before it is
+// complete.
+func (s *store) begin(w storage.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inflight == nil {
+		s.inflight = make(map[string]storage.Writer)
+	}
+	s.inflight[w.Key()] = w
+}
+
+// abandon discards a file registered with begin which will never be
+// completed.
+func (s *store) abandon(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.abort(key)
+}
+
+// abort discards an in-flight file, if it is still in flight. The caller
+// must hold the lock.
+func (s *store) abort(key string) error {
+	w, ok := s.inflight[key]
+	if !ok {
+		return nil
+	}
+	delete(s.inflight, key)
+	log.Printf("discarding incomplete file: %s", key)
+	err := w.Abort()
+	if err != nil {
+		log.Errorf("could not discard %s: %v", key, err)
+	}
+	return err
+}
+
+// commit makes a newly received NGF available to clients, with its data
+// from w. If identical data is already stored, w is discarded and the NGF
+// shares the existing blob, otherwise w is committed to the backend.
+func (s *store) commit(ngf *NGF, w storage.Writer) error {
+	s.mu.Lock()
+	if s.share(ngf, w.Key()) {
+		delete(s.inflight, w.Key())
+		err := w.Abort()
+		if err != nil {
+			log.Errorf("could not discard duplicate %s: %v", w.Key(), err)
+		}
+		s.add(ngf)
+		s.changed()
+		s.mu.Unlock()
+		return nil
+	}
+	s.mu.Unlock()
+
+	err := w.Commit()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.inflight, w.Key())
+	// identical data may have been stored while we were committing
+	if s.share(ngf, w.Key()) {
+		_ = s.remove(w.Key())
+	} else {
+		s.addBlob(ngf)
+	}
+	s.add(ngf)
+	s.changed()
+	return nil
+}
+
+// commitExisting makes a new NGF available to clients, with data already
+// in the store with the same SHA-256 (ngf.Blob). It returns false if there
+// is no such data. The NGF is given the next id if it is added.
+func (s *store) commitExisting(ngf *NGF) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.blobs[ngf.Blob]
+	if !ok {
+		return false
+	}
+	b.use(ngf)
+	ngf.Id = atomic.AddUint32(&globalId, 1)
+	s.add(ngf)
+	s.changed()
+	return true
+}
+
+// add makes an NGF available. If it has a name, it replaces the NGF
+// with that name, if there is one, which goes to the history, and it is
+// given the next version of the name if it does not have one yet. The
+// caller must hold the lock.
+func (s *store) add(ngf *NGF) {
+	if ngf.Name != "" {
+		if ngf.Version == 0 {
+			ngf.Version = s.nextVersion(ngf.Name)
+		}
+		if i, previous := findIn(s.ngfs, ref{name: ngf.Name}); previous != nil {
+			s.ngfs = append(s.ngfs[:i], s.ngfs[i+1:]...)
+			s.history = append(s.history, previous)
+			s.trimHistory(ngf.Name)
+		}
+	}
+	s.ngfs = append(s.ngfs, ngf)
+}
+
+// nextVersion returns the version for the next NGF copied to a name,
+// following any version of it the store still has. The caller must hold
+// the lock.
+func (s *store) nextVersion(name string) uint32 {
+	version := uint32(0)
+	for _, list := range [][]*NGF{s.ngfs, s.trash, s.history, s.purging} {
+		for _, ngf := range list {
+			if ngf.Name == name && ngf.Version > version {
+				version = ngf.Version
+			}
+		}
+	}
+	return version + 1
+}
+
+// trimHistory purges the oldest versions of a name, beyond the number
+// which are kept. The caller must hold the lock.
+func (s *store) trimHistory(name string) {
+	versions := 0
+	for _, ngf := range s.history {
+		if ngf.Name == name {
+			versions++
+		}
+	}
+	kept := s.history[:0]
+	for _, ngf := range s.history {
+		if ngf.Name == name && versions > s.versions {
+			log.Printf("dropping old version of %s: %v", name, ngf)
+			s.purge(ngf)
+			versions--
+			continue
+		}
+		kept = append(kept, ngf)
+	}
+	s.history = kept
+}
+
+// share points an NGF at an existing blob with the same content, if there
+// is one, returning true if it did. The caller must hold the lock.
+func (s *store) share(ngf *NGF, key string) bool {
+	b, ok := s.blobs[ngf.Blob]
+	if !ok {
+		return false
+	}
+	log.Debugf("%s is a duplicate of %s", key, b.key)
+	b.use(ngf)
+	return true
+}
+
+// addBlob registers the data for an NGF as a new blob, or as another
+// reference to an existing one. The caller must hold the lock.
+func (s *store) addBlob(ngf *NGF) {
+	if ngf.Blob == "" {
+		return
+	}
+	if s.blobs == nil {
+		s.blobs = make(map[string]*blob)
+	}
+	b, ok := s.blobs[ngf.Blob]
+	if !ok {
+		b = &blob{key: ngf.StoreKey, size: ngf.Size, storedSize: ngf.StoredSize, compression: ngf.Compression}
+		s.blobs[ngf.Blob] = b
+	}
+	b.refs++
+}
+
+// unref removes an NGF's reference to its blob, removing the data from the
+// backend if nothing else uses it. The caller must hold the lock.
+func (s *store) unref(ngf *NGF) error {
+	if b, ok := s.blobs[ngf.Blob]; ok {
+		b.refs--
+		if b.refs > 0 {
+			log.Debugf("keeping %s, still used by %d items", b.key, b.refs)
+			return nil
+		}
+		delete(s.blobs, ngf.Blob)
+	}
+	return s.remove(ngf.StoreKey)
+}
+
+// knows returns true if the store key belongs to any file the store is
+// tracking.
+func (s *store) knows(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.inflight[key]; ok {
+		return true
+	}
+	for _, list := range [][]*NGF{s.ngfs, s.trash, s.history, s.purging} {
+		for _, ngf := range list {
+			if ngf.StoreKey == key {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// list returns a copy of the NGFs currently available, oldest first.
+func (s *store) list() []NGF {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return copyNGFs(s.ngfs)
+}
+
+// listTrash returns a copy of the NGFs in the trash, oldest first.
+func (s *store) listTrash() []NGF {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return copyNGFs(s.trash)
+}
+
+func copyNGFs(ngfs []*NGF) []NGF {
+	out := make([]NGF, 0, len(ngfs))
+	for _, ngf := range ngfs {
+		out = append(out, *ngf)
+	}
+	return out
+}
+
+// findIn returns the NGF referred to, the most recent with the name (and
+// version, if given) if there is more than one, or the last one if the
+// ref is empty.
+func findIn(ngfs []*NGF, r ref) (int, *NGF) {
+	if len(ngfs) == 0 {
+		return -1, nil
+	}
+	if r.sel != nil {
+		selected := selectIn(ngfs, r.sel, time.Now())
+		if len(selected) == 0 {
+			return -1, nil
+		}
+		return selected[0], ngfs[selected[0]]
+	}
+	if r.name != "" {
+		for i := len(ngfs) - 1; i >= 0; i-- {
+			if ngfs[i].Name == r.name && (r.version == 0 || ngfs[i].Version == r.version) {
+				return i, ngfs[i]
+			}
+		}
+		return -1, nil
+	}
+	if r.id == 0 {
+		return len(ngfs) - 1, ngfs[len(ngfs)-1]
+	}
+	for i, ngf := range ngfs {
+		if ngf.Id == r.id {
+			return i, ngf
+		}
+	}
+	return -1, nil
+}
+
+// lookupAny returns the NGF with the given id, wherever it is. The caller
+// must hold the lock.
+func (s *store) lookupAny(id uint32) *NGF {
+	for _, list := range [][]*NGF{s.ngfs, s.trash, s.history, s.purging} {
+		for _, ngf := range list {
+			if ngf.Id == id {
+				return ngf
+			}
+		}
+	}
+	return nil
+}
+
+// findVersion returns an available NGF, or with a version or an id, a
+// previous version from the history. Ids are looked for in the history
+// too, so that a client can ask again by id for a previous version it
+// first asked for by name and version. The caller must hold the lock.
+func (s *store) findVersion(r ref) *NGF {
+	_, ngf := findIn(s.ngfs, r)
+	if ngf == nil && (r.version != 0 || r.id != 0) {
+		_, ngf = findIn(s.history, r)
+	}
+	return ngf
+}
+
+// get returns a copy of an available NGF, or a previous version of one.
+func (s *store) get(r ref) (NGF, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ngf := s.findVersion(r)
+	if ngf == nil {
+		return NGF{}, false
+	}
+	return *ngf, true
+}
+
+// acquire finds an available NGF, or a previous version of one, and
+// registers a reader on it. The caller must call release once it has
+// finished reading the file.
+func (s *store) acquire(r ref) (NGF, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ngf := s.findVersion(r)
+	if ngf == nil {
+		return NGF{}, false
+	}
+	ngf.readers++
+	return *ngf, true
+}
+
+// release unregisters a reader obtained via acquire. If the NGF was purged
+// while being read, and this was the last reader, its data is released.
+func (s *store) release(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ngf := s.lookupAny(id)
+	if ngf == nil {
+		log.Errorf("release of unknown ngf %d", id)
+		return
+	}
+	ngf.readers--
+	if ngf.purged && ngf.readers == 0 {
+		for i := range s.purging {
+			if s.purging[i] == ngf {
+				s.purging = append(s.purging[:i], s.purging[i+1:]...)
+				break
+			}
+		}
+		_ = s.unref(ngf)
+	}
+}
+
+// burn removes an available NGF from view. Unless purge is set, or the
+// store has no trash retention, it is moved to the trash. When purging,
+// NGFs already in the trash may also be referred to.
+func (s *store) burn(r ref, purge bool) (NGF, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, ngf := findIn(s.ngfs, r)
+	if ngf != nil {
+		s.ngfs = append(s.ngfs[:i], s.ngfs[i+1:]...)
+	} else if purge && (r.id != 0 || r.name != "") {
+		i, ngf = findIn(s.trash, r)
+		if ngf == nil {
+			return NGF{}, false
+		}
+		s.trash = append(s.trash[:i], s.trash[i+1:]...)
+	} else {
+		return NGF{}, false
+	}
+	burned := s.discard(ngf, purge)
+	s.changed()
+	return burned, true
+}
+
+// burnSelected burns every available NGF picked by the selector, as burn
+// does, and returns them, newest first.
+func (s *store) burnSelected(sel *secure.Selector, purge bool) []NGF {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	burned := []NGF{}
+	// newest first, so removing each doesn't move the rest
+	for _, i := range selectIn(s.ngfs, sel, time.Now()) {
+		ngf := s.ngfs[i]
+		s.ngfs = append(s.ngfs[:i], s.ngfs[i+1:]...)
+		burned = append(burned, s.discard(ngf, purge))
+	}
+	if len(burned) > 0 {
+		s.changed()
+	}
+	return burned
+}
+
+// wouldBurn returns a copy of the NGF burn would burn, without burning it.
+func (s *store) wouldBurn(r ref, purge bool) (NGF, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ngf := findIn(s.ngfs, r); ngf != nil {
+		return *ngf, true
+	}
+	if purge && (r.id != 0 || r.name != "") {
+		if _, ngf := findIn(s.trash, r); ngf != nil {
+			return *ngf, true
+		}
+	}
+	return NGF{}, false
+}
+
+// selected returns copies of the available NGFs picked by the selector,
+// newest first.
+func (s *store) selected(sel *secure.Selector) []NGF {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := []NGF{}
+	for _, i := range selectIn(s.ngfs, sel, time.Now()) {
+		out = append(out, *s.ngfs[i])
+	}
+	return out
+}
+
+// discard moves an NGF which has been burned to the trash, or purges it,
+// and returns a copy of it. The caller must hold the lock.
+func (s *store) discard(ngf *NGF, purge bool) NGF {
+	if purge || s.trashRetention == 0 {
+		s.purge(ngf)
+		return *ngf
+	}
+
+	ngf.BurnedAt = time.Now()
+	s.trash = append(s.trash, ngf)
+	return *ngf
+}
+
+// restore moves an NGF from the trash (the most recently burned if the
+// ref is empty) back to the available NGFs. A named NGF replaces the one
+// with the same name, if there is one.
+func (s *store) restore(r ref) (NGF, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, ngf := findIn(s.trash, r)
+	if ngf == nil {
+		return NGF{}, false
+	}
+	s.trash = append(s.trash[:i], s.trash[i+1:]...)
+
+	ngf.BurnedAt = time.Time{}
+	s.add(ngf)
+	// keep them in id order, so the most recent is still last
+	sort.Slice(s.ngfs, func(i, j int) bool { return s.ngfs[i].Id < s.ngfs[j].Id })
+	s.changed()
+	return *ngf, true
+}
+
+// rollback makes a previous version of a name (the one most recently
+// replaced if the ref has no version) the available one again, replacing
+// the current version, which goes to the history.
+func (s *store) rollback(r ref) (NGF, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, ngf := findIn(s.history, r)
+	if ngf == nil {
+		return NGF{}, false
+	}
+	s.history = append(s.history[:i], s.history[i+1:]...)
+
+	s.add(ngf)
+	sort.Slice(s.ngfs, func(i, j int) bool { return s.ngfs[i].Id < s.ngfs[j].Id })
+	s.changed()
+	return *ngf, true
+}
+
+// listVersions returns copies of the versions of a name which are kept,
+// oldest first, and the id of the one available, 0 if none is.
+func (s *store) listVersions(name string) ([]NGF, uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	versions := []NGF{}
+	current := uint32(0)
+	for _, ngf := range s.history {
+		if ngf.Name == name {
+			versions = append(versions, *ngf)
+		}
+	}
+	if _, ngf := findIn(s.ngfs, ref{name: name}); ngf != nil {
+		versions = append(versions, *ngf)
+		current = ngf.Id
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+	return versions, current
+}
+
+// expire purges NGFs which have been in the trash longer than the
+// retention period.
+func (s *store) expire(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := s.trash[:0]
+	for _, ngf := range s.trash {
+		if now.Sub(ngf.BurnedAt) >= s.trashRetention {
+			log.Printf("trash expired: %v", ngf)
+			s.purge(ngf)
+			continue
+		}
+		kept = append(kept, ngf)
+	}
+	expired := len(kept) < len(s.trash)
+	s.trash = kept
+	if expired {
+		s.changed()
+	}
+}
+
+// purge releases the data for an NGF which has already been taken out of
+// the available and trash lists. If it is being read this is deferred
+// until the last reader releases it. The caller must hold the lock.
+func (s *store) purge(ngf *NGF) {
+	if ngf.readers > 0 {
+		log.Debugf("deferring removal of %s, %d readers active", ngf.StoreKey, ngf.readers)
+		ngf.purged = true
+		s.purging = append(s.purging, ngf)
+		return
+	}
+	_ = s.unref(ngf)
+}
+
+// removeAll removes the files for every NGF the store knows about,
+// including those in the trash, those still being read and those still
+// being received. It is intended for use at shutdown, and returns the
+// number of files which could not be removed.
+func (s *store) removeAll() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	failed := 0
+	for _, list := range [][]*NGF{s.ngfs, s.trash, s.history, s.purging} {
+		for _, ngf := range list {
+			if s.unref(ngf) != nil {
+				failed++
+			}
+		}
+	}
+	for key := range s.inflight {
+		if s.abort(key) != nil {
+			failed++
+		}
+	}
+	s.ngfs = nil
+	s.trash = nil
+	s.history = nil
+	s.purging = nil
+	s.inflight = nil
+	return failed
+}
+
+// removeTransient removes the files still being received, and those
+// purged but still being read, returning the number which could not be
+// removed. It is intended for use at shutdown when the rest of the store
+// is being kept.
+func (s *store) removeTransient() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	failed := 0
+	for _, ngf := range s.purging {
+		if s.unref(ngf) != nil {
+			failed++
+		}
+	}
+	for key := range s.inflight {
+		if s.abort(key) != nil {
+			failed++
+		}
+	}
+	s.purging = nil
+	s.inflight = nil
+	return failed
+}
+
+// storeIndex is the on-disk form of the store, used to persist it across
+// restarts.
+type storeIndex struct {
+	LastId  uint32
+	NGFs    []NGF
+	Trash   []NGF
+	History []NGF
+}
+
+// save writes the available, trashed and previous versions of NGFs to an
+// index file, so they can be loaded again by the next server. NGFs being
+// purged are not included.
+func (s *store) save(path string, lastId uint32) error {
+	s.mu.Lock()
+	index := s.index(lastId)
+	s.mu.Unlock()
+	return writeIndex(path, index)
+}
+
+// changed saves the index after the NGFs have changed, if the store is
+// keeping one up to date, so that it is current if the server stops
+// without shutting down. The caller must hold the lock.
+func (s *store) changed() {
+	if s.indexPath == "" {
+		return
+	}
+	err := writeIndex(s.indexPath, s.index(atomic.LoadUint32(&globalId)))
+	if err != nil {
+		log.Errorf("could not save index to %s: %v", s.indexPath, err)
+	}
+}
+
+// index returns the NGFs to save in an index. The caller must hold the
+// lock.
+func (s *store) index(lastId uint32) storeIndex {
+	return storeIndex{LastId: lastId, NGFs: copyNGFs(s.ngfs), Trash: copyNGFs(s.trash), History: copyNGFs(s.history)}
+}
+
+// writeIndex writes an index to a temporary file, which then replaces
+// the index at path, so the index is never left half written.
+func writeIndex(path string, index storeIndex) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(f).Encode(index)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+// load reads an index file written by save, adding any NGFs whose files
+// still exist to the store. It returns the last id that was in use.
+func (s *store) load(path string) (uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	index := storeIndex{}
+	err = json.NewDecoder(f).Decode(&index)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, list := range []struct {
+		from []NGF
+		to   *[]*NGF
+	}{{index.NGFs, &s.ngfs}, {index.Trash, &s.trash}, {index.History, &s.history}} {
+		for i := range list.from {
+			ngf := list.from[i]
+			if _, err := s.backend.Stat(ngf.StoreKey); err != nil {
+				log.Errorf("dropping %v from index: %v", ngf, err)
+				continue
+			}
+			*list.to = append(*list.to, &ngf)
+			s.addBlob(&ngf)
+		}
+	}
+	return index.LastId, nil
+}
+
+// remove deletes a file from the backend.
+func (s *store) remove(key string) error {
+	log.Printf("removing file: %s", key)
+	err := s.backend.Delete(key)
+	if errors.Is(err, storage.ErrNotFound) {
+		log.Errorf("could not remove %s: already gone", key)
+		return nil
+	}
+	if err != nil {
+		log.Errorf("could not remove %s: %v", key, err)
+	}
+	return err
+}
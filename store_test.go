@@ -0,0 +1,387 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tardisx/netgiv/storage"
+)
+
+// tempNGF adds an NGF to the store, with data unique to its id.
+func tempNGF(t *testing.T, s *store, id uint32) *NGF {
+	t.Helper()
+	return storeNGF(t, s, id, fmt.Sprintf("data %d", id))
+}
+
+func storeNGF(t *testing.T, s *store, id uint32, data string) *NGF {
+	t.Helper()
+	w, err := s.backend.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.begin(w)
+	_, _ = w.Write([]byte(data))
+	sum := sha256.Sum256([]byte(data))
+	ngf := &NGF{Id: id, StoreKey: w.Key(), Size: uint64(len(data)), Blob: hex.EncodeToString(sum[:])}
+	err = s.commit(ngf, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ngf
+}
+
+// tempFile writes some data to the backend, without the store knowing.
+func tempFile(t *testing.T, b storage.Backend) string {
+	t.Helper()
+	w, err := b.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = w.Write([]byte("data"))
+	err = w.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w.Key()
+}
+
+func exists(b storage.Backend, key string) bool {
+	_, err := b.Stat(key)
+	return err == nil
+}
+
+func TestStoreBurn(t *testing.T) {
+	s := store{backend: storage.NewMemory(0)}
+	ngf := tempNGF(t, &s, 1)
+
+	_, found := s.burn(ref{id: 1}, false)
+	if !found {
+		t.Fatal("ngf not found for burning")
+	}
+	if exists(s.backend, ngf.StoreKey) {
+		t.Error("file still exists after burn")
+	}
+	if len(s.list()) != 0 {
+		t.Error("burned ngf still in list")
+	}
+	if _, found := s.burn(ref{id: 1}, false); found {
+		t.Error("ngf burned twice")
+	}
+}
+
+func TestStoreBurnWhileReading(t *testing.T) {
+	s := store{backend: storage.NewMemory(0)}
+	ngf := tempNGF(t, &s, 1)
+	tempNGF(t, &s, 2)
+
+	// acquire the most recent, then the one we will burn, twice
+	latest, found := s.acquire(ref{})
+	if !found || latest.Id != 2 {
+		t.Fatalf("expected to acquire id 2, got %v", latest)
+	}
+	s.release(latest.Id)
+
+	_, _ = s.acquire(ref{id: 1})
+	_, _ = s.acquire(ref{id: 1})
+
+	_, found = s.burn(ref{id: 1}, false)
+	if !found {
+		t.Fatal("ngf not found for burning")
+	}
+	if _, found := s.acquire(ref{id: 1}); found {
+		t.Error("could acquire burned ngf")
+	}
+	if len(s.list()) != 1 {
+		t.Error("burned ngf still in list")
+	}
+
+	s.release(1)
+	if !exists(s.backend, ngf.StoreKey) {
+		t.Error("file removed with a reader still active")
+	}
+	s.release(1)
+	if exists(s.backend, ngf.StoreKey) {
+		t.Error("file not removed after last reader finished")
+	}
+}
+
+func TestStoreTrash(t *testing.T) {
+	s := store{backend: storage.NewMemory(0), trashRetention: time.Hour}
+	ngf := tempNGF(t, &s, 1)
+	tempNGF(t, &s, 2)
+
+	_, found := s.burn(ref{id: 1}, false)
+	if !found {
+		t.Fatal("ngf not found for burning")
+	}
+	if !exists(s.backend, ngf.StoreKey) {
+		t.Error("file removed when moving to trash")
+	}
+	if len(s.list()) != 1 || len(s.listTrash()) != 1 {
+		t.Fatalf("expected 1 available and 1 in trash, got %v and %v", s.list(), s.listTrash())
+	}
+
+	restored, found := s.restore(ref{})
+	if !found || restored.Id != 1 {
+		t.Fatalf("expected to restore id 1, got %v", restored)
+	}
+	if latest, _ := s.acquire(ref{}); latest.Id != 2 {
+		t.Errorf("restored ngf became the latest")
+	}
+	s.release(2)
+
+	// trashed items expire after the retention period
+	_, _ = s.burn(ref{id: 1}, false)
+	s.expire(time.Now())
+	if !exists(s.backend, ngf.StoreKey) {
+		t.Error("file removed before retention period")
+	}
+	s.expire(time.Now().Add(2 * time.Hour))
+	if exists(s.backend, ngf.StoreKey) || len(s.listTrash()) != 0 {
+		t.Error("trash not expired after retention period")
+	}
+
+	// purging skips the trash
+	ngf = tempNGF(t, &s, 3)
+	_, _ = s.burn(ref{id: 3}, true)
+	if exists(s.backend, ngf.StoreKey) || len(s.listTrash()) != 0 {
+		t.Error("purged ngf not removed")
+	}
+}
+
+func TestStoreSaveLoad(t *testing.T) {
+	s := store{backend: storage.NewMemory(0), trashRetention: time.Hour}
+	tempNGF(t, &s, 1)
+	tempNGF(t, &s, 2)
+	missing := tempNGF(t, &s, 3)
+	_, _ = s.burn(ref{id: 2}, false)
+	_ = s.backend.Delete(missing.StoreKey)
+
+	indexPath := filepath.Join(t.TempDir(), "index.json")
+	err := s.save(indexPath, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := store{backend: s.backend}
+	lastId, err := loaded.load(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastId != 3 {
+		t.Errorf("expected last id 3, got %d", lastId)
+	}
+	if l := loaded.list(); len(l) != 1 || l[0].Id != 1 {
+		t.Errorf("expected only id 1 to be loaded, got %v", l)
+	}
+	if l := loaded.listTrash(); len(l) != 1 || l[0].Id != 2 {
+		t.Errorf("expected id 2 in the trash, got %v", l)
+	}
+}
+
+func TestStoreIndexPath(t *testing.T) {
+	dir := t.TempDir()
+	s := store{backend: storage.NewMemory(0), trashRetention: time.Hour, indexPath: filepath.Join(dir, "index.json")}
+	tempNGF(t, &s, 1)
+	tempNGF(t, &s, 2)
+
+	// the index is current without a save, as if the server had crashed
+	loaded := store{backend: s.backend}
+	_, err := loaded.load(s.indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := loaded.list(); len(l) != 2 {
+		t.Errorf("expected 2 ngfs in the index, got %v", l)
+	}
+
+	_, _ = s.burn(ref{id: 1}, false)
+	loaded = store{backend: s.backend}
+	_, err = loaded.load(s.indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := loaded.listTrash(); len(l) != 1 || l[0].Id != 1 {
+		t.Errorf("expected id 1 in the trash in the index, got %v", l)
+	}
+
+	// no temporary files left behind
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 1 {
+		t.Errorf("expected only the index in %s, got %v", dir, files)
+	}
+}
+
+func TestStoreDedup(t *testing.T) {
+	s := store{backend: storage.NewMemory(0), trashRetention: time.Hour}
+	first := storeNGF(t, &s, 1, "same")
+	second := storeNGF(t, &s, 2, "same")
+	tempNGF(t, &s, 3)
+
+	if first.StoreKey != second.StoreKey {
+		t.Fatal("identical data stored twice")
+	}
+	if keys, _ := s.backend.List(); len(keys) != 2 {
+		t.Errorf("expected 2 files in the backend, got %v", keys)
+	}
+
+	// still referenced from the trash
+	_, _ = s.burn(ref{id: 1}, false)
+	_, _ = s.burn(ref{id: 2}, true)
+	if !exists(s.backend, first.StoreKey) {
+		t.Fatal("shared data removed while still in use")
+	}
+
+	// the references survive a restart
+	indexPath := filepath.Join(t.TempDir(), "index.json")
+	err := s.save(indexPath, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := store{backend: s.backend}
+	_, err = loaded.load(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again := storeNGF(t, &loaded, 4, "same")
+	if again.StoreKey != first.StoreKey {
+		t.Error("loaded store did not share identical data")
+	}
+	_, _ = loaded.burn(ref{id: 1}, true)
+	if !exists(s.backend, first.StoreKey) {
+		t.Fatal("shared data removed while still in use after loading")
+	}
+	_, _ = loaded.burn(ref{id: 4}, true)
+	if exists(s.backend, first.StoreKey) {
+		t.Error("shared data not removed once unused")
+	}
+}
+
+func TestStoreCommitExisting(t *testing.T) {
+	s := store{backend: storage.NewMemory(0)}
+	existing := storeNGF(t, &s, 1, "same")
+
+	ngf := &NGF{Blob: existing.Blob}
+	if !s.commitExisting(ngf) {
+		t.Fatal("existing data not found")
+	}
+	if ngf.StoreKey != existing.StoreKey || ngf.Size != 4 || ngf.Id == 0 {
+		t.Errorf("new ngf does not use the existing data: %v", ngf)
+	}
+	if len(s.list()) != 2 {
+		t.Error("new ngf not added")
+	}
+
+	if s.commitExisting(&NGF{Blob: "unknown"}) {
+		t.Error("added ngf for data that is not stored")
+	}
+}
+
+// namedNGF adds an NGF copied to a name to the store, with data unique to
+// its id.
+func namedNGF(t *testing.T, s *store, id uint32, name string) *NGF {
+	t.Helper()
+	w, err := s.backend.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.begin(w)
+	data := fmt.Sprintf("data %d", id)
+	_, _ = w.Write([]byte(data))
+	sum := sha256.Sum256([]byte(data))
+	ngf := &NGF{Id: id, Name: name, StoreKey: w.Key(), Size: uint64(len(data)), Blob: hex.EncodeToString(sum[:])}
+	err = s.commit(ngf, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ngf
+}
+
+func TestStoreNames(t *testing.T) {
+	s := store{backend: storage.NewMemory(0), versions: 1}
+	named := func(id uint32, name string) *NGF {
+		return namedNGF(t, &s, id, name)
+	}
+
+	first := named(1, "staging.env")
+	named(2, "other")
+	named(3, "staging.env")
+	if len(s.list()) != 2 {
+		t.Errorf("replaced ngf still available: %v", s.list())
+	}
+	if ngf, ok := s.get(ref{name: "staging.env"}); !ok || ngf.Id != 3 {
+		t.Errorf("name refers to %v, not the newest", ngf)
+	}
+	if ngf, ok := s.get(ref{id: 1}); !ok || ngf.Id != 1 {
+		t.Error("replaced ngf can not be got by id")
+	}
+	if !exists(s.backend, first.StoreKey) {
+		t.Error("previous version not kept")
+	}
+
+	named(4, "staging.env")
+	if exists(s.backend, first.StoreKey) {
+		t.Error("oldest version not dropped")
+	}
+	if len(s.history) != 1 || s.history[0].Id != 3 {
+		t.Errorf("history is %v, want only 3", s.history)
+	}
+
+	if _, ok := s.burn(ref{name: "staging.env"}, false); !ok {
+		t.Fatal("could not burn by name")
+	}
+	if _, ok := s.get(ref{name: "staging.env"}); ok {
+		t.Error("burned name still available")
+	}
+	if _, ok := s.get(ref{name: "missing"}); ok {
+		t.Error("found a name never used")
+	}
+}
+
+func TestStoreVersions(t *testing.T) {
+	s := store{backend: storage.NewMemory(0), versions: 2}
+	for id := uint32(1); id <= 4; id++ {
+		ngf := namedNGF(t, &s, id, "db.sql")
+		if ngf.Version != id {
+			t.Errorf("copy %d given version %d", id, ngf.Version)
+		}
+	}
+
+	versions, current := s.listVersions("db.sql")
+	if len(versions) != 3 || versions[0].Version != 2 || versions[2].Version != 4 || current != 4 {
+		t.Errorf("versions are %v, current %d", versions, current)
+	}
+	if ngf, ok := s.get(ref{name: "db.sql", version: 3}); !ok || ngf.Id != 3 {
+		t.Errorf("version 3 is %v", ngf)
+	}
+	if _, ok := s.get(ref{name: "db.sql", version: 1}); ok {
+		t.Error("version beyond those kept still available")
+	}
+
+	// with no version, the one replaced most recently
+	ngf, ok := s.rollback(ref{name: "db.sql"})
+	if !ok || ngf.Version != 3 {
+		t.Fatalf("rolled back to %v", ngf)
+	}
+	if ngf, _ := s.get(ref{name: "db.sql"}); ngf.Version != 3 {
+		t.Errorf("current version is %d after rollback", ngf.Version)
+	}
+	if ngf, ok := s.rollback(ref{name: "db.sql", version: 2}); !ok || ngf.Version != 2 {
+		t.Fatalf("rolled back to %v", ngf)
+	}
+	versions, current = s.listVersions("db.sql")
+	if len(versions) != 3 || current != 2 {
+		t.Errorf("versions are %v, current %d", versions, current)
+	}
+	if _, ok := s.rollback(ref{name: "db.sql", version: 2}); ok {
+		t.Error("rolled back to the current version")
+	}
+
+	// numbering carries on from the newest kept
+	if ngf := namedNGF(t, &s, 5, "db.sql"); ngf.Version != 5 {
+		t.Errorf("new copy given version %d", ngf.Version)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/tardisx/netgiv/storage"
+)
+
+// minCompressSize is the least data worth compressing in storage. Less
+// than this is stored as it is, as compressing it saves little, if
+// anything, and can even make it bigger.
+const minCompressSize = 1024
+
+// storedWriter writes the data of an NGF to storage, through compression
+// if it is worth it, which is decided once there is enough data to be
+// worth compressing, so the kind must be known by then. It keeps the size
+// and stored size of the NGF up to date.
+type storedWriter struct {
+	ngf        *NGF
+	stored     *countingWriter
+	out        io.Writer
+	pending    []byte // the start of the data, until out is decided on
+	compressor *zstd.Encoder
+	compress   bool // compress the data, if it is of a compressible kind
+}
+
+func newStoredWriter(w io.Writer, ngf *NGF, compress bool) *storedWriter {
+	return &storedWriter{ngf: ngf, stored: &countingWriter{w: w}, compress: compress}
+}
+
+// start decides whether to compress the data, and writes what is pending.
+func (w *storedWriter) start() error {
+	w.out = w.stored
+	if w.compress && len(w.pending) >= minCompressSize && w.ngf.Encryption == 0 && compressibleKind(w.ngf.Kind) {
+		log.Debugf("compressing %s in storage", w.ngf.StoreKey)
+		compressor, err := zstd.NewWriter(w.stored)
+		if err != nil {
+			return err
+		}
+		w.compressor = compressor
+		w.out = compressor
+		w.ngf.Compression = "zstd"
+	}
+	_, err := w.out.Write(w.pending)
+	w.pending = nil
+	return err
+}
+
+func (w *storedWriter) Write(p []byte) (int, error) {
+	if w.out == nil {
+		w.pending = append(w.pending, p...)
+		w.ngf.Size += uint64(len(p))
+		if len(w.pending) < minCompressSize {
+			return len(p), nil
+		}
+		return len(p), w.start()
+	}
+	n, err := w.out.Write(p)
+	w.ngf.Size += uint64(n)
+	return n, err
+}
+
+// Close finishes the data, and records how much space it takes. It is
+// safe to call more than once.
+func (w *storedWriter) Close() error {
+	if w.out == nil {
+		err := w.start()
+		if err != nil {
+			return err
+		}
+	}
+	if w.compressor != nil {
+		err := w.compressor.Close()
+		w.compressor = nil
+		if err != nil {
+			return err
+		}
+	}
+	w.ngf.StoredSize = uint64(w.stored.n)
+	return nil
+}
+
+// storedReader reads the data of an NGF from storage, decompressed.
+type storedReader struct {
+	io.Reader
+	f            io.Closer
+	decompressor *zstd.Decoder
+}
+
+// openStored opens the data of an NGF, starting offset bytes into it.
+func openStored(backend storage.Backend, ngf NGF, offset uint64) (io.ReadCloser, error) {
+	// compressed data can only be read from the start
+	openAt := int64(offset)
+	if ngf.Compression != "" {
+		openAt = 0
+	}
+	f, err := backend.Open(ngf.StoreKey, openAt)
+	if err != nil {
+		return nil, err
+	}
+	r := &storedReader{Reader: f, f: f}
+	if ngf.Compression == "zstd" {
+		r.decompressor, err = zstd.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		r.Reader = r.decompressor
+		_, err = io.CopyN(io.Discard, r.decompressor, int64(offset))
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *storedReader) Close() error {
+	if r.decompressor != nil {
+		r.decompressor.Close()
+	}
+	return r.f.Close()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/tardisx/netgiv/storage"
+)
+
+// storeData writes data to the backend as the data of ngf, in pieces,
+// as it arrives from a client.
+func storeData(t *testing.T, backend storage.Backend, ngf *NGF, data string, compress bool) {
+	t.Helper()
+	file, err := backend.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ngf.StoreKey = file.Key()
+	w := newStoredWriter(file, ngf, compress)
+	for _, piece := range []string{data[:10], "", data[10:]} {
+		_, err = w.Write([]byte(piece))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = file.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readStored(t *testing.T, backend storage.Backend, ngf NGF, offset uint64, length int64) string {
+	t.Helper()
+	r, err := openStored(backend, ngf, offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var in io.Reader = r
+	if length >= 0 {
+		in = io.LimitReader(r, length)
+	}
+	got, err := io.ReadAll(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(got)
+}
+
+func TestStoredCompressed(t *testing.T) {
+	backend := storage.NewMemory(0)
+	first := strings.Repeat("the first file\n", 100)
+	second := strings.Repeat("the second file\n", 100)
+	data := first + second
+
+	ngf := NGF{Kind: "UTF-8 text"}
+	storeData(t, backend, &ngf, data, true)
+	if ngf.Compression != "zstd" {
+		t.Fatalf("text stored with compression %q", ngf.Compression)
+	}
+	if ngf.Size != uint64(len(data)) {
+		t.Errorf("size is %d, not %d", ngf.Size, len(data))
+	}
+	info, err := backend.Stat(ngf.StoreKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ngf.StoredSize != uint64(info.Size) || ngf.StoredSize >= ngf.Size {
+		t.Errorf("stored size is %d, stored %d bytes of %d", ngf.StoredSize, info.Size, ngf.Size)
+	}
+
+	if got := readStored(t, backend, ngf, 0, -1); got != data {
+		t.Errorf("read back %d bytes, not the %d stored", len(got), len(data))
+	}
+	// a member is read from part way through the decompressed data
+	if got := readStored(t, backend, ngf, uint64(len(first)), int64(len(second))); got != second {
+		t.Errorf("read back %q for the second member", got)
+	}
+}
+
+func TestStoredUncompressed(t *testing.T) {
+	backend := storage.NewMemory(0)
+	data := strings.Repeat("some text\n", 10)
+	for _, ngf := range []NGF{{Kind: "UTF-8 text"}, {Kind: "application/gzip"}} {
+		compress := ngf.Kind != "UTF-8 text"
+		storeData(t, backend, &ngf, data, compress)
+		if ngf.Compression != "" {
+			t.Errorf("%s stored with compression %q", ngf.Kind, ngf.Compression)
+		}
+		if ngf.Size != uint64(len(data)) || ngf.StoredSize != ngf.Size {
+			t.Errorf("%s has size %d, stored size %d", ngf.Kind, ngf.Size, ngf.StoredSize)
+		}
+		if got := readStored(t, backend, ngf, 10, 10); got != data[10:20] {
+			t.Errorf("read back %q from %s", got, ngf.Kind)
+		}
+	}
+}
+
+func TestStoredTiny(t *testing.T) {
+	backend := storage.NewMemory(0)
+	ngf := NGF{Kind: "UTF-8 text"}
+	storeData(t, backend, &ngf, "a little bit of text\n", true)
+	if ngf.Compression != "" || ngf.StoredSize > ngf.Size {
+		t.Errorf("tiny item stored with compression %q, taking %d bytes for %d", ngf.Compression, ngf.StoredSize, ngf.Size)
+	}
+	if got := readStored(t, backend, ngf, 0, -1); got != "a little bit of text\n" {
+		t.Errorf("read back %q", got)
+	}
+}